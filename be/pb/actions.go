@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+
+	"be.monk.house/notification"
+)
+
+// Payload Mattermost sends when a message action button is clicked
+type MattermostActionRequest struct {
+	UserID    string `json:"user_id"`
+	UserName  string `json:"user_name"`
+	ChannelID string `json:"channel_id"`
+	PostID    string `json:"post_id"`
+	Context   struct {
+		TaskID    string `json:"task_id"`
+		Action    string `json:"action"`
+		ChannelID string `json:"channel_id"`
+		Signature string `json:"signature"`
+	} `json:"context"`
+}
+
+// Response to an action, the update replaces the message and props of the post
+type MattermostActionResponse struct {
+	Update        map[string]any `json:"update,omitempty"`
+	EphemeralText string         `json:"ephemeral_text,omitempty"`
+}
+
+// Handle the Accept/Start/Mark done buttons of the task posts:
+// update the task status as the user who clicked and show the new state on the post.
+func handleMattermostAction(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	var payload MattermostActionRequest
+	if err := c.BindBody(&payload); err != nil {
+		return c.JSON(400, map[string]string{"error": "invalid request"})
+	}
+
+	action := payload.Context.Action
+	channelId := payload.Context.ChannelID
+	if !notification.VerifyAction(payload.Context.TaskID, action, channelId, payload.Context.Signature) {
+		return c.JSON(401, map[string]string{"error": "invalid signature"})
+	}
+
+	// the signed context only holds for the channel it was posted to,
+	// and only its members can click the buttons there
+	if payload.ChannelID != channelId {
+		return c.JSON(401, map[string]string{"error": "invalid signature"})
+	}
+	member, err := isChannelMember(channelId, payload.UserID)
+	if err != nil {
+		log.Printf("Mattermost action: failed to check the membership of %s in channel %s: %v", payload.UserID, channelId, err)
+		return c.JSON(502, map[string]string{"error": "failed to check the channel membership"})
+	}
+	if !member {
+		return c.JSON(403, map[string]string{"error": "not a member of the channel"})
+	}
+
+	status, ok := notification.ActionStatuses[action]
+	if !ok {
+		return c.JSON(400, map[string]string{"error": "unknown action"})
+	}
+
+	ephemeral := func(text string) error {
+		return c.JSON(200, MattermostActionResponse{EphemeralText: text})
+	}
+
+	user, err := findUserByMattermostId(app, payload.UserID)
+	if err != nil {
+		return ephemeral("Bạn chưa có tài khoản, hãy đăng nhập ứng dụng trước.")
+	}
+
+	task, err := app.FindRecordById("tasks", payload.Context.TaskID)
+	if err != nil {
+		return ephemeral("Công việc không còn tồn tại.")
+	}
+
+	if !canChangeTask(app, user, task) {
+		return ephemeral("Bạn không có quyền cập nhật công việc này.")
+	}
+
+	current := task.GetString("status")
+	changed := current != status
+	if action == notification.ActionAccept {
+		// accepting a task that was already started or done doesn't move it back
+		changed = current == "" || current == "backlog"
+	}
+
+	if changed {
+		task.Set("status", status)
+		task.Set("updatedBy", user.Id)
+
+		if err := app.SaveWithContext(withAuditActor(context.Background(), userAuditActor(user)), task); err != nil {
+			log.Printf("Mattermost action %s on task %s failed: %v", action, task.Id, err)
+			return ephemeral("Không thể cập nhật công việc, vui lòng thử lại sau.")
+		}
+	}
+
+	actor := user.GetString("name")
+	if username := user.GetString("username"); username != "" {
+		actor = "@" + username
+	}
+	state := fmt.Sprintf("**Trạng thái:** %s (%s)", notification.StatusLabel(task.GetString("status"), "vi"), actor)
+
+	// the original post is the outbox message that was sent as this post
+	entry, err := app.FindFirstRecordByFilter(notification.OutboxCollection, "post_id = {:post}", dbx.Params{"post": payload.PostID})
+	if err != nil {
+		return ephemeral(state)
+	}
+
+	message := entry.GetString("message")
+	if entry.GetString("recipient_type") != notification.RecipientUser {
+		message = "@here " + message
+	}
+
+	// a consolidated post shows the status of each of its tasks
+	if taskIds := entry.GetStringSlice("tasks"); len(taskIds) > 0 {
+		return c.JSON(200, MattermostActionResponse{
+			Update: map[string]any{
+				"message": message,
+				"props":   notification.BulkTaskActionProps(notification.LoadActionTasks(app, taskIds), channelId),
+			},
+			EphemeralText: fmt.Sprintf("%s: %s", task.GetString("title"), state),
+		})
+	}
+
+	return c.JSON(200, MattermostActionResponse{
+		Update: map[string]any{
+			"message": message + "\n\n" + state,
+			"props":   notification.TaskActionProps(task.Id, task.GetString("status"), channelId),
+		},
+	})
+}
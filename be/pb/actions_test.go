@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+
+	"be.monk.house/notification"
+)
+
+func newActionRequest(t *testing.T, payload MattermostActionRequest) (*core.RequestEvent, *httptest.ResponseRecorder) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	e := &core.RequestEvent{}
+	e.Request = httptest.NewRequest("POST", "/api/mattermost/actions", strings.NewReader(string(body)))
+	e.Request.Header.Set("Content-Type", "application/json")
+	e.Response = rec
+	return e, rec
+}
+
+// The signed context can't be replayed from another channel or by a user outside of it.
+// Both are rejected before the app is used.
+func TestMattermostActionChannel(t *testing.T) {
+	t.Setenv("MATTERMOST_ACTION_SECRET", "secret")
+	t.Setenv("MATTERMOST_BOT_TOKEN", "bot")
+
+	mm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v4/channels/chan1/members/member1" {
+			w.Write([]byte(`{"user_id":"member1"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"not found"}`))
+	}))
+	defer mm.Close()
+	t.Setenv("MATTERMOST_SERVER_URL", mm.URL)
+
+	signed := func(userId string, channelId string) MattermostActionRequest {
+		var payload MattermostActionRequest
+		payload.UserID = userId
+		payload.ChannelID = channelId
+		payload.Context.TaskID = "PQQ00001"
+		payload.Context.Action = notification.ActionDone
+		payload.Context.ChannelID = "chan1"
+		payload.Context.Signature = notification.SignAction("PQQ00001", notification.ActionDone, "chan1")
+		return payload
+	}
+
+	scenarios := []struct {
+		name    string
+		payload MattermostActionRequest
+		status  int
+	}{
+		{"other channel", signed("member1", "chan2"), 401},
+		{"not a member", signed("outsider", "chan1"), 403},
+	}
+
+	for _, s := range scenarios {
+		e, rec := newActionRequest(t, s.payload)
+		if err := handleMattermostAction(e, nil); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if rec.Code != s.status {
+			t.Errorf("%s: expected status %d, got %d: %s", s.name, s.status, rec.Code, rec.Body.String())
+		}
+	}
+
+	member, err := isChannelMember("chan1", "member1")
+	if err != nil || !member {
+		t.Errorf("expected member1 to be a member of chan1, got %v, %v", member, err)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const auditCollection = "audit_log"
+
+// Collections whose changes are written to the audit log
+var auditedCollections = []string{"tasks", "users", "departments", "groups", "feedbacks", membershipsCollection}
+
+// Max audit entries per page of /api/audit
+const auditMaxPerPage = 200
+
+// Who made a change and from which request
+type auditActor struct {
+	Id        string
+	Type      string // user, superuser or system
+	Name      string
+	IP        string
+	UserAgent string
+	Method    string
+	Path      string
+}
+
+type auditActorKey struct{}
+
+// Attach the actor to the context of a save, for the changes made outside of the records API
+func withAuditActor(ctx context.Context, actor *auditActor) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// Actor of the records API requests, by record being saved.
+// The record save hooks run before the request hook returns.
+var requestAuditActors sync.Map
+
+// The auth and metadata of a request
+func requestAuditActor(e *core.RequestEvent) *auditActor {
+	actor := &auditActor{
+		Type:      "system",
+		IP:        e.RealIP(),
+		UserAgent: e.Request.UserAgent(),
+		Method:    e.Request.Method,
+		Path:      e.Request.URL.Path,
+	}
+
+	if e.Auth != nil {
+		actor.Id = e.Auth.Id
+		if e.Auth.IsSuperuser() {
+			actor.Type = "superuser"
+			actor.Name = e.Auth.Email()
+		} else {
+			actor.Type = "user"
+			actor.Name = e.Auth.GetString("name")
+		}
+	}
+
+	return actor
+}
+
+// Audit actor of a user acting outside of a request, eg. from a Mattermost command
+func userAuditActor(user *core.Record) *auditActor {
+	return &auditActor{Id: user.Id, Type: "user", Name: user.GetString("name")}
+}
+
+// Remember the actor of a records API request while the record is saved
+func trackAuditRequest(e *core.RecordRequestEvent) error {
+	requestAuditActors.Store(e.Record, requestAuditActor(e.RequestEvent))
+	defer requestAuditActors.Delete(e.Record)
+
+	return e.Next()
+}
+
+func auditActorOf(e *core.RecordEvent) *auditActor {
+	if actor, ok := requestAuditActors.Load(e.Record); ok {
+		return actor.(*auditActor)
+	}
+	if e.Context != nil {
+		if actor, ok := e.Context.Value(auditActorKey{}).(*auditActor); ok {
+			return actor
+		}
+	}
+	return &auditActor{Type: "system"}
+}
+
+// Old and new value of a changed field
+type auditChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// Values of hidden fields (passwords, tokens) are masked
+func auditValue(field core.Field, value any) any {
+	if field.GetHidden() || field.Type() == core.FieldTypePassword {
+		return "***"
+	}
+	return value
+}
+
+func auditIsEmpty(value any) bool {
+	raw, _ := json.Marshal(value)
+	switch string(raw) {
+	case `""`, "null", "[]", "{}", "false", "0":
+		return true
+	}
+	return false
+}
+
+// Changed fields between the original and the saved record, every non-empty
+// field of a created record and every field of a deleted one
+func auditChanges(record *core.Record, action string) map[string]auditChange {
+	changes := map[string]auditChange{}
+
+	for _, field := range record.Collection().Fields {
+		name := field.GetName()
+		if name == "id" || field.Type() == core.FieldTypeAutodate {
+			continue
+		}
+
+		value := record.Get(name)
+
+		switch action {
+		case "create":
+			if !auditIsEmpty(value) {
+				changes[name] = auditChange{New: auditValue(field, value)}
+			}
+		case "delete":
+			if !auditIsEmpty(value) {
+				changes[name] = auditChange{Old: auditValue(field, value)}
+			}
+		default:
+			old := record.Original().Get(name)
+			oldRaw, _ := json.Marshal(old)
+			newRaw, _ := json.Marshal(value)
+			if string(oldRaw) != string(newRaw) {
+				changes[name] = auditChange{Old: auditValue(field, old), New: auditValue(field, value)}
+			}
+		}
+	}
+
+	return changes
+}
+
+// Append an entry for the record change, updates without a changed field are skipped
+func writeAuditEntry(app core.App, e *core.RecordEvent, action string) {
+	changes := auditChanges(e.Record, action)
+	if action == "update" && len(changes) == 0 {
+		return
+	}
+
+	collection, err := app.FindCollectionByNameOrId(auditCollection)
+	if err != nil {
+		log.Printf("Failed to audit %s %s: %v", e.Record.Collection().Name, e.Record.Id, err)
+		return
+	}
+
+	actor := auditActorOf(e)
+
+	entry := core.NewRecord(collection)
+	entry.Set("collection", e.Record.Collection().Name)
+	entry.Set("record", e.Record.Id)
+	entry.Set("action", action)
+	entry.Set("actor", actor.Id)
+	entry.Set("actor_type", actor.Type)
+	entry.Set("actor_name", actor.Name)
+	entry.Set("changes", changes)
+	entry.Set("ip", actor.IP)
+	entry.Set("user_agent", actor.UserAgent)
+	entry.Set("method", actor.Method)
+	entry.Set("path", actor.Path)
+
+	if err := app.Save(entry); err != nil {
+		log.Printf("Failed to audit %s %s: %v", e.Record.Collection().Name, e.Record.Id, err)
+	}
+}
+
+var errAuditAppendOnly = errors.New("audit log entries can't be changed or deleted")
+
+// Record the changes of the audited collections and keep the audit log append-only
+func bindAuditHooks(app *pocketbase.PocketBase) {
+	app.OnRecordCreateRequest(auditedCollections...).BindFunc(trackAuditRequest)
+	app.OnRecordUpdateRequest(auditedCollections...).BindFunc(trackAuditRequest)
+	app.OnRecordDeleteRequest(auditedCollections...).BindFunc(trackAuditRequest)
+
+	app.OnRecordAfterCreateSuccess(auditedCollections...).BindFunc(func(e *core.RecordEvent) error {
+		writeAuditEntry(app, e, "create")
+		return e.Next()
+	})
+	app.OnRecordAfterUpdateSuccess(auditedCollections...).BindFunc(func(e *core.RecordEvent) error {
+		writeAuditEntry(app, e, "update")
+		return e.Next()
+	})
+	app.OnRecordAfterDeleteSuccess(auditedCollections...).BindFunc(func(e *core.RecordEvent) error {
+		writeAuditEntry(app, e, "delete")
+		return e.Next()
+	})
+
+	app.OnRecordUpdate(auditCollection).BindFunc(func(e *core.RecordEvent) error {
+		return errAuditAppendOnly
+	})
+	app.OnRecordDelete(auditCollection).BindFunc(func(e *core.RecordEvent) error {
+		return errAuditAppendOnly
+	})
+}
+
+// Without the audit.view permission a user can only read the history of the
+// tasks they created or that belong to a department they manage.
+func canViewTaskAudit(app core.App, auth *core.Record, taskId string) bool {
+	task, err := app.FindRecordById("tasks", taskId)
+	if err != nil {
+		return false
+	}
+
+	return task.GetString("createdBy") == auth.Id || isDepartmentManager(app, auth.Id, task.GetStringSlice("departments"))
+}
+
+// Query the audit log, newest first. Filters (query params): collection, record,
+// actor, action, field (changed field), from and to (dates), page and perPage.
+func handleAuditLog(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	query := c.Request.URL.Query()
+	collection := query.Get("collection")
+	recordId := query.Get("record")
+
+	if !hasPermission(app, c.Auth, permissionAuditView) {
+		if collection != "tasks" || recordId == "" || !canViewTaskAudit(app, c.Auth, recordId) {
+			return c.JSON(403, map[string]string{"error": "not allowed to view this audit log"})
+		}
+	}
+
+	exprs := []dbx.Expression{}
+	for _, param := range []string{"collection", "record", "actor", "action"} {
+		if value := query.Get(param); value != "" {
+			exprs = append(exprs, dbx.HashExp{param: value})
+		}
+	}
+
+	if field := query.Get("field"); field != "" {
+		if strings.ContainsAny(field, `."$[]`) {
+			return c.JSON(400, map[string]string{"error": "invalid field"})
+		}
+		exprs = append(exprs, dbx.NewExp("json_type(changes, {:path}) IS NOT NULL", dbx.Params{"path": "$." + field}))
+	}
+
+	for _, param := range []string{"from", "to"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		dt, err := types.ParseDateTime(value)
+		if err != nil || dt.IsZero() {
+			return c.JSON(400, map[string]string{"error": "invalid " + param + " date"})
+		}
+		if param == "from" {
+			exprs = append(exprs, dbx.NewExp("created >= {:from}", dbx.Params{"from": dt.String()}))
+		} else {
+			exprs = append(exprs, dbx.NewExp("created <= {:to}", dbx.Params{"to": dt.String()}))
+		}
+	}
+
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(query.Get("perPage"))
+	if perPage < 1 || perPage > auditMaxPerPage {
+		perPage = 50
+	}
+
+	var total int
+	if err := app.RecordQuery(auditCollection).Select("count(*)").AndWhere(dbx.And(exprs...)).Row(&total); err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to query the audit log"})
+	}
+
+	entries := []*core.Record{}
+	err := app.RecordQuery(auditCollection).
+		AndWhere(dbx.And(exprs...)).
+		OrderBy("created DESC", "id DESC").
+		Limit(int64(perPage)).
+		Offset(int64((page - 1) * perPage)).
+		All(&entries)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to query the audit log"})
+	}
+
+	return c.JSON(200, map[string]any{
+		"page":       page,
+		"perPage":    perPage,
+		"totalItems": total,
+		"items":      entries,
+	})
+}
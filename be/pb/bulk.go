@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+
+	"be.monk.house/notification"
+)
+
+// Max tasks per bulk request
+const bulkTaskLimit = 1000
+
+// Max tasks listed in a consolidated notification
+const bulkNotificationListLimit = 50
+
+// A task to create in bulk
+type BulkTaskInput struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Status      string   `json:"status"`
+	Label       string   `json:"label"`
+	DueDate     string   `json:"due_date"`
+	Assignees   []string `json:"assignees"`
+	Departments []string `json:"departments"`
+	// assign the task to the members of its departments
+	AssignMembers bool `json:"assign_members"`
+}
+
+// Validation error of one task, Row is the index in the request
+type BulkRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// Create the tasks in one transaction, nothing is created when any task is invalid.
+// Tasks created by a user have the user as createdBy and the assignees are checked
+// against the user permissions. ctx carries the audit actor.
+func createTasksInBulk(ctx context.Context, app core.App, inputs []BulkTaskInput, auth *core.Record) ([]*core.Record, []BulkRowError, error) {
+	collection, err := app.FindCollectionByNameOrId("tasks")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tasks := []*core.Record{}
+	rowErrors := []BulkRowError{}
+	errInvalidRows := fmt.Errorf("invalid rows")
+
+	err = app.RunInTransaction(func(txApp core.App) error {
+		// the per-task notifications are replaced by the consolidated ones
+		ctx := withoutTaskNotifications(ctx)
+
+		for i, input := range inputs {
+			task := core.NewRecord(collection)
+			task.Set("title", input.Title)
+			task.Set("description", input.Description)
+			task.Set("status", input.Status)
+			if input.Status == "" {
+				task.Set("status", "todo")
+			}
+			task.Set("label", input.Label)
+			task.Set("due_date", input.DueDate)
+			task.Set("assignees", input.Assignees)
+			task.Set("departments", input.Departments)
+			if input.AssignMembers {
+				assignDepartmentMembers(txApp, task)
+			}
+			if !auth.IsSuperuser() {
+				task.Set("createdBy", auth.Id)
+			}
+
+			if input.Title == "" {
+				rowErrors = append(rowErrors, BulkRowError{Row: i, Error: "title is required"})
+				continue
+			}
+
+			if !auth.IsSuperuser() {
+				if userId := unassignableUser(txApp, auth, task); userId != "" {
+					rowErrors = append(rowErrors, BulkRowError{Row: i, Error: fmt.Sprintf("not allowed to assign the task to user %s", userId)})
+					continue
+				}
+			}
+
+			if err := txApp.SaveWithContext(ctx, task); err != nil {
+				rowErrors = append(rowErrors, BulkRowError{Row: i, Error: err.Error()})
+				continue
+			}
+			tasks = append(tasks, task)
+		}
+
+		if len(rowErrors) > 0 {
+			return errInvalidRows
+		}
+		return nil
+	})
+
+	if len(rowErrors) > 0 {
+		return nil, rowErrors, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tasks, nil, nil
+}
+
+// Send one new-task notification per address listing all of its new tasks,
+// instead of one message per task.
+func notifyTasksCreatedInBulk(app core.App, outbox *notification.Outbox, tasks []*core.Record) {
+	type group struct {
+		recipient notification.Recipient
+		tasks     []*core.Record
+	}
+
+	groups := map[string]*group{}
+	order := []string{}
+	for _, task := range tasks {
+		recipients, unreachable := resolveTaskRecipients(app, notification.EventTaskCreated, task.GetStringSlice("assignees"), task.GetStringSlice("departments"))
+		for _, r := range unreachable {
+			log.Printf("Task %s: %s %s has no notification address and was not notified", task.Id, r.Type, r.ID)
+		}
+
+		for _, recipient := range recipients {
+			key := recipient.Notifier + ":" + recipient.Address
+			if _, ok := groups[key]; !ok {
+				groups[key] = &group{recipient: recipient}
+				order = append(order, key)
+			}
+			groups[key].tasks = append(groups[key].tasks, task)
+		}
+	}
+
+	for _, key := range order {
+		g := groups[key]
+
+		data := notification.TemplateData{Count: len(g.tasks)}
+		taskIds := make([]string, 0, len(g.tasks))
+		for i, task := range g.tasks {
+			taskIds = append(taskIds, task.Id)
+			if i >= bulkNotificationListLimit {
+				continue
+			}
+			data.Tasks = append(data.Tasks, notification.TaskTemplateData(task))
+		}
+		data.More = len(g.tasks) - len(data.Tasks)
+
+		// the tasks share the post, for their thread, buttons and delivery report
+		if err := outbox.EnqueueBulkTemplate([]notification.Recipient{g.recipient}, data, taskIds); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Create many tasks at once (eg. an import) with one notification per channel
+func handleBulkCreateTasks(c *core.RequestEvent, app *pocketbase.PocketBase, outbox *notification.Outbox) error {
+	var requestBody struct {
+		Tasks []BulkTaskInput `json:"tasks"`
+	}
+
+	if err := c.BindBody(&requestBody); err != nil {
+		return c.JSON(400, map[string]string{"error": "invalid request body"})
+	}
+
+	if len(requestBody.Tasks) == 0 {
+		return c.JSON(400, map[string]string{"error": "no tasks to create"})
+	}
+	if len(requestBody.Tasks) > bulkTaskLimit {
+		return c.JSON(400, map[string]string{"error": fmt.Sprintf("at most %d tasks can be created at once", bulkTaskLimit)})
+	}
+
+	tasks, rowErrors, err := createTasksInBulk(withAuditActor(context.Background(), requestAuditActor(c)), app, requestBody.Tasks, c.Auth)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to create tasks"})
+	}
+	if len(rowErrors) > 0 {
+		return c.JSON(400, map[string]any{
+			"error":  "some tasks are invalid, nothing was created",
+			"errors": rowErrors,
+		})
+	}
+
+	notifyTasksCreatedInBulk(app, outbox, tasks)
+
+	ids := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		ids = append(ids, task.Id)
+	}
+
+	return c.JSON(200, map[string]any{
+		"success": true,
+		"count":   len(ids),
+		"ids":     ids,
+	})
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Channel members fetched per Mattermost API page (the API max)
+const channelMembersPageSize = 200
+
+// Default posts per user per minute, overridable with MATTERMOST_POST_RATE_LIMIT
+const defaultMattermostPostRateLimit = 10
+
+func getMattermostPostRateLimit() int {
+	if limit, err := strconv.Atoi(os.Getenv("MATTERMOST_POST_RATE_LIMIT")); err == nil && limit > 0 {
+		return limit
+	}
+	return defaultMattermostPostRateLimit
+}
+
+type MattermostTeam struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Type        string `json:"type"`
+}
+
+type MattermostChannel struct {
+	ID          string `json:"id"`
+	TeamID      string `json:"team_id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Type        string `json:"type"`
+	DeleteAt    int64  `json:"delete_at"`
+}
+
+// Outcome of a department membership sync
+type DepartmentSyncResult struct {
+	Departments int `json:"departments"`
+	Added       int `json:"added"`
+	Removed     int `json:"removed"`
+	Unknown     int `json:"unknown"`
+	Failed      int `json:"failed"`
+}
+
+// Error response of the Mattermost API
+type mattermostAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *mattermostAPIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("API request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("API request failed with status %d: %s", e.StatusCode, e.Message)
+}
+
+// Call the Mattermost API as the bot, the JSON response is decoded into out
+func mattermostBotRequest(method string, path string, body any, out any) error {
+	mmToken := os.Getenv("MATTERMOST_BOT_TOKEN")
+	if mmToken == "" {
+		return fmt.Errorf("MATTERMOST_BOT_TOKEN is not set")
+	}
+
+	return mattermostRequest(mmToken, method, path, body, out)
+}
+
+// Call the Mattermost API with the access token, the JSON response is decoded into out
+func mattermostRequest(mmToken string, method string, path string, body any, out any) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return fmt.Errorf("failed to marshal request body: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest(method, getMattermostConfig().ServerURL+path, &reqBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+mmToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &mattermostAPIError{StatusCode: resp.StatusCode}
+		var errBody struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&errBody) == nil {
+			apiErr.Message = errBody.Message
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Teams the bot is a member of
+func fetchBotTeams() ([]MattermostTeam, error) {
+	teams := []MattermostTeam{}
+	if err := mattermostBotRequest("GET", "/api/v4/users/me/teams", nil, &teams); err != nil {
+		return nil, err
+	}
+	return teams, nil
+}
+
+// Public and private channels of the team the bot is a member of
+func fetchBotChannels(teamId string) ([]MattermostChannel, error) {
+	all := []MattermostChannel{}
+	if err := mattermostBotRequest("GET", fmt.Sprintf("/api/v4/users/me/teams/%s/channels", teamId), nil, &all); err != nil {
+		return nil, err
+	}
+
+	channels := []MattermostChannel{}
+	for _, channel := range all {
+		if (channel.Type == "O" || channel.Type == "P") && channel.DeleteAt == 0 {
+			channels = append(channels, channel)
+		}
+	}
+	return channels, nil
+}
+
+// Check that the bot can post to the channel
+func botIsChannelMember(channelId string) (bool, error) {
+	return isChannelMember(channelId, "me")
+}
+
+// Check that the Mattermost user ("me" for the bot) is a member of the channel
+func isChannelMember(channelId string, mmUserId string) (bool, error) {
+	if channelId == "" || mmUserId == "" {
+		return false, nil
+	}
+
+	err := mattermostBotRequest("GET", fmt.Sprintf("/api/v4/channels/%s/members/%s", channelId, mmUserId), nil, nil)
+	if apiErr, ok := err.(*mattermostAPIError); ok && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusForbidden) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Mattermost user ids of the channel members
+func fetchChannelMemberIds(channelId string) ([]string, error) {
+	ids := []string{}
+	for page := 0; ; page++ {
+		members := []struct {
+			UserID string `json:"user_id"`
+		}{}
+		path := fmt.Sprintf("/api/v4/channels/%s/members?page=%d&per_page=%d", channelId, page, channelMembersPageSize)
+		if err := mattermostBotRequest("GET", path, nil, &members); err != nil {
+			return nil, err
+		}
+
+		for _, member := range members {
+			ids = append(ids, member.UserID)
+		}
+
+		if len(members) < channelMembersPageSize {
+			return ids, nil
+		}
+	}
+}
+
+var invalidChannelNameChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// Mattermost channel handle (lowercase letters, digits, "-" and "_") from a department code
+func mattermostChannelName(value string) string {
+	name := invalidChannelNameChars.ReplaceAllString(strings.ToLower(strings.TrimSpace(value)), "-")
+	name = strings.Trim(name, "-_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// Reject a department channel the bot can't post to.
+// Skipped when the bot isn't configured.
+func validateDepartmentChannel(e *core.RecordRequestEvent) error {
+	channelId := e.Record.GetString("mattermost_channel")
+	if channelId == "" || os.Getenv("MATTERMOST_BOT_TOKEN") == "" {
+		return e.Next()
+	}
+	if !e.Record.IsNew() && e.Record.Original().GetString("mattermost_channel") == channelId {
+		return e.Next()
+	}
+
+	member, err := botIsChannelMember(channelId)
+	if err != nil {
+		log.Printf("Failed to check the bot membership of channel %s: %v", channelId, err)
+		return apis.NewBadRequestError("Failed to verify the Mattermost channel, try again later", nil)
+	}
+	if !member {
+		return apis.NewBadRequestError("The bot is not a member of this Mattermost channel, add it to the channel first", nil)
+	}
+
+	return e.Next()
+}
+
+// Whether the user is linked to the channel: their direct channel with the bot or the
+// channel of one of their departments. Superusers can post to any channel.
+func canPostToChannel(app core.App, auth *core.Record, channelID string) bool {
+	if auth == nil || channelID == "" {
+		return false
+	}
+	if auth.IsSuperuser() {
+		return true
+	}
+	if auth.GetString("mm_channel") == channelID {
+		return true
+	}
+
+	_, err := app.FindFirstRecordByFilter(
+		membershipsCollection,
+		"user = {:user} && department.mattermost_channel = {:channel}",
+		dbx.Params{"user": auth.Id, "channel": channelID},
+	)
+	return err == nil
+}
+
+// Resolve Mattermost user ids to user record ids, by the linked Mattermost id
+// then by email. Bots and unknown users are left out.
+func resolveMattermostUserIds(app core.App, mmUserIds []string) (ids []string, unknown int, err error) {
+	if len(mmUserIds) == 0 {
+		return []string{}, 0, nil
+	}
+
+	records, err := app.FindAllRecords("users", dbx.Or(
+		dbx.In("mm_user_id", toAny(mmUserIds)...),
+		dbx.And(dbx.In("id", toAny(mmUserIds)...), dbx.HashExp{"mm_user_id": ""}),
+	))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ids = []string{}
+	found := map[string]bool{}
+	for _, record := range records {
+		if linked := record.GetString("mm_user_id"); linked != "" {
+			found[linked] = true
+		} else {
+			found[record.Id] = true
+		}
+		ids = append(ids, record.Id)
+	}
+
+	missing := []string{}
+	for _, id := range mmUserIds {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return ids, 0, nil
+	}
+
+	// accounts created before the Mattermost login, matched by email
+	mmUsers := []MattermostUser{}
+	if err := mattermostBotRequest("POST", "/api/v4/users/ids", missing, &mmUsers); err != nil {
+		return nil, 0, err
+	}
+
+	for _, mmUser := range mmUsers {
+		if mmUser.IsBot {
+			continue
+		}
+		if mmUser.Email == "" {
+			unknown++
+			continue
+		}
+		record, err := findMattermostUser(app, &mmUser)
+		if err != nil || record == nil {
+			unknown++
+			continue
+		}
+		if !slices.Contains(ids, record.Id) {
+			ids = append(ids, record.Id)
+		}
+	}
+
+	return ids, unknown, nil
+}
+
+// Add the channel members missing from the department as members, and remove
+// the members who left the channel. Leads and managers are kept.
+func syncDepartmentMemberships(app core.App, dept *core.Record, userIds []string) (added int, removed int, err error) {
+	collection, err := app.FindCollectionByNameOrId(membershipsCollection)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	memberships, err := app.FindAllRecords(collection, dbx.HashExp{"department": dept.Id})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	current := []string{}
+	for _, membership := range memberships {
+		userId := membership.GetString("user")
+		current = append(current, userId)
+
+		if membership.GetString("role") != roleMember || slices.Contains(userIds, userId) {
+			continue
+		}
+		if err := app.Delete(membership); err != nil {
+			return added, removed, err
+		}
+		removed++
+	}
+
+	for _, userId := range userIds {
+		if slices.Contains(current, userId) {
+			continue
+		}
+		membership := core.NewRecord(collection)
+		membership.Set("user", userId)
+		membership.Set("department", dept.Id)
+		membership.Set("role", roleMember)
+		if err := app.Save(membership); err != nil {
+			return added, removed, err
+		}
+		added++
+	}
+
+	return added, removed, nil
+}
+
+// Align the members of the departments linked to a Mattermost channel with
+// the channel members.
+func runDepartmentSync(app core.App) (*DepartmentSyncResult, error) {
+	if os.Getenv("MATTERMOST_BOT_TOKEN") == "" {
+		return nil, fmt.Errorf("MATTERMOST_BOT_TOKEN is not set")
+	}
+
+	departments, err := app.FindAllRecords("departments", dbx.NewExp("mattermost_channel != ''"))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DepartmentSyncResult{}
+	for _, dept := range departments {
+		mmUserIds, err := fetchChannelMemberIds(dept.GetString("mattermost_channel"))
+		if err != nil {
+			log.Printf("Department sync: failed to fetch the channel members of department %s: %v", dept.Id, err)
+			result.Failed++
+			continue
+		}
+
+		members, unknown, err := resolveMattermostUserIds(app, mmUserIds)
+		if err != nil {
+			log.Printf("Department sync: failed to resolve the members of department %s: %v", dept.Id, err)
+			result.Failed++
+			continue
+		}
+		result.Unknown += unknown
+
+		added, removed, err := syncDepartmentMemberships(app, dept, members)
+		result.Added += added
+		result.Removed += removed
+		if err != nil {
+			log.Printf("Department sync: failed to save the members of department %s: %v", dept.Id, err)
+			result.Failed++
+			continue
+		}
+		result.Departments++
+	}
+
+	log.Printf("Department sync: %d departments, %d members added, %d removed, %d unknown users, %d failed",
+		result.Departments, result.Added, result.Removed, result.Unknown, result.Failed)
+
+	return result, nil
+}
+
+// List the Mattermost teams of the bot
+func handleMattermostTeams(c *core.RequestEvent) error {
+	teams, err := fetchBotTeams()
+	if err != nil {
+		return c.JSON(502, map[string]string{"error": "failed to fetch Mattermost teams", "details": err.Error()})
+	}
+
+	return c.JSON(200, map[string]any{"teams": teams})
+}
+
+// List the channels of a team the bot can post to, with the department linked to each
+func handleMattermostChannels(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	channels, err := fetchBotChannels(c.Request.PathValue("id"))
+	if err != nil {
+		return c.JSON(502, map[string]string{"error": "failed to fetch Mattermost channels", "details": err.Error()})
+	}
+
+	type channelItem struct {
+		MattermostChannel
+		Department string `json:"department"`
+	}
+
+	items := make([]channelItem, 0, len(channels))
+	for _, channel := range channels {
+		item := channelItem{MattermostChannel: channel}
+		if dept, err := app.FindFirstRecordByFilter("departments", "mattermost_channel = {:channel}", dbx.Params{"channel": channel.ID}); err == nil {
+			item.Department = dept.Id
+		}
+		items = append(items, item)
+	}
+
+	return c.JSON(200, map[string]any{"channels": items})
+}
+
+// Create a Mattermost channel for a department that has none and link it
+func handleCreateDepartmentChannel(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	var requestBody struct {
+		TeamID      string `json:"team_id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+		Private     bool   `json:"private"`
+	}
+
+	if err := c.BindBody(&requestBody); err != nil {
+		return c.JSON(400, map[string]string{"error": "invalid request body"})
+	}
+	if requestBody.TeamID == "" {
+		return c.JSON(400, map[string]string{"error": "team_id is required"})
+	}
+
+	dept, err := app.FindRecordById("departments", c.Request.PathValue("id"))
+	if err != nil {
+		return c.JSON(404, map[string]string{"error": "department not found"})
+	}
+	if dept.GetString("mattermost_channel") != "" {
+		return c.JSON(400, map[string]string{"error": "the department already has a Mattermost channel"})
+	}
+
+	name := requestBody.Name
+	if name == "" {
+		name = dept.GetString("code")
+	}
+	name = mattermostChannelName(name)
+	if len(name) < 2 {
+		return c.JSON(400, map[string]string{"error": "invalid channel name, use lowercase letters, digits, \"-\" or \"_\""})
+	}
+
+	displayName := requestBody.DisplayName
+	if displayName == "" {
+		displayName = dept.GetString("name")
+	}
+
+	channelType := "O"
+	if requestBody.Private {
+		channelType = "P"
+	}
+
+	// the bot creates the channel, so it is a member
+	var channel MattermostChannel
+	err = mattermostBotRequest("POST", "/api/v4/channels", map[string]string{
+		"team_id":      requestBody.TeamID,
+		"name":         name,
+		"display_name": displayName,
+		"type":         channelType,
+	}, &channel)
+	if err != nil {
+		return c.JSON(502, map[string]string{"error": "failed to create the Mattermost channel", "details": err.Error()})
+	}
+
+	dept.Set("mattermost_channel", channel.ID)
+	if err := app.SaveWithContext(withAuditActor(context.Background(), requestAuditActor(c)), dept); err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to save the department channel"})
+	}
+
+	return c.JSON(200, map[string]any{
+		"success": true,
+		"channel": channel,
+	})
+}
+
+// Run the department membership sync now
+func handleDepartmentSync(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	result, err := runDepartmentSync(app)
+	if err != nil {
+		return c.JSON(502, map[string]string{"error": err.Error()})
+	}
+
+	return c.JSON(200, map[string]any{
+		"success": true,
+		"result":  result,
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"be.monk.house/notification"
+)
+
+// Digest sections, also the values of the departments "digest_sections" field
+const (
+	digestSectionOpen      = "open"
+	digestSectionDueWeek   = "due_this_week"
+	digestSectionOverdue   = "overdue"
+	digestSectionCompleted = "completed"
+)
+
+var digestSections = []string{digestSectionOpen, digestSectionDueWeek, digestSectionOverdue, digestSectionCompleted}
+
+// Max tasks listed per section
+const digestSectionLimit = 10
+
+// Default user digest schedule (in the user's timezone), overridable with USER_DIGEST_CRON
+const defaultUserDigestCron = "0 8 * * 1-5"
+
+func getUserDigestSchedule() *cron.Schedule {
+	expr := os.Getenv("USER_DIGEST_CRON")
+	if expr == "" {
+		expr = defaultUserDigestCron
+	}
+
+	schedule, err := cron.NewSchedule(expr)
+	if err != nil {
+		log.Printf("Invalid USER_DIGEST_CRON %q: %v", expr, err)
+		schedule, _ = cron.NewSchedule(defaultUserDigestCron)
+	}
+
+	return schedule
+}
+
+// Post the digests that are due at this minute.
+// Runs every minute, users follow the user digest schedule in their own timezone
+// and departments follow their own "digest_schedule".
+func runDigests(app core.App, outbox *notification.Outbox, userSchedule *cron.Schedule) {
+	now := time.Now()
+
+	users, err := findDigestUsers(app, userSchedule, now)
+	if err != nil {
+		log.Printf("Digests: failed to load users: %v", err)
+		return
+	}
+
+	for _, user := range users {
+		sendUserDigest(app, outbox, user, now.In(notification.TimezoneLocation(user.GetString("timezone"))))
+	}
+
+	departments, err := app.FindAllRecords("departments", dbx.Not(dbx.HashExp{"digest_schedule": ""}))
+	if err != nil {
+		log.Printf("Digests: failed to load departments: %v", err)
+		return
+	}
+
+	for _, dept := range departments {
+		schedule, err := cron.NewSchedule(dept.GetString("digest_schedule"))
+		if err != nil {
+			log.Printf("Digests: invalid schedule of department %s: %v", dept.Id, err)
+			continue
+		}
+		if !schedule.IsDue(cron.NewMoment(now.In(time.Local))) {
+			continue
+		}
+
+		sendDepartmentDigest(app, outbox, dept, now.In(time.Local))
+	}
+}
+
+// Users with a Mattermost channel whose digest is due now. The user digest schedule
+// is checked once per timezone, the query leaves out the users who turned their
+// digest off or get it weekly when it isn't Monday for them.
+func findDigestUsers(app core.App, schedule *cron.Schedule, now time.Time) ([]*core.Record, error) {
+	timezones := []string{}
+	err := app.DB().
+		Select("timezone").
+		Distinct(true).
+		From("users").
+		Where(dbx.Not(dbx.HashExp{"mm_channel": ""})).
+		Column(&timezones)
+	if err != nil {
+		return nil, err
+	}
+
+	due := []any{}
+	mondays := []any{}
+	for _, timezone := range timezones {
+		local := now.In(notification.TimezoneLocation(timezone))
+		if !schedule.IsDue(cron.NewMoment(local)) {
+			continue
+		}
+		due = append(due, timezone)
+		if local.Weekday() == time.Monday {
+			mondays = append(mondays, timezone)
+		}
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	// users without preferences get the daily digest
+	frequency := "COALESCE([[prefs.digest]], '')"
+	weekly := dbx.NewExp(frequency+" != {:weekly}", dbx.Params{"weekly": notification.DigestWeekly})
+	if len(mondays) > 0 {
+		weekly = dbx.Or(weekly, dbx.In("users.timezone", mondays...))
+	}
+
+	users := []*core.Record{}
+	err = app.RecordQuery("users").
+		LeftJoin(notification.PreferencesCollection+" prefs", dbx.NewExp("[[prefs.user]] = [[users.id]]")).
+		AndWhere(dbx.Not(dbx.HashExp{"users.mm_channel": ""})).
+		AndWhere(dbx.In("users.timezone", due...)).
+		AndWhere(dbx.NewExp(frequency+" != {:off}", dbx.Params{"off": notification.DigestOff})).
+		AndWhere(weekly).
+		All(&users)
+
+	return users, err
+}
+
+func sendUserDigest(app core.App, outbox *notification.Outbox, user *core.Record, now time.Time) {
+	since := lastDigestAt(app, notification.RecipientUser, user.Id)
+
+	sections := buildDigestSections(app, jsonArrayContains("assignees", user.Id), digestSections, since, now)
+	if len(sections) == 0 {
+		return
+	}
+
+	data := notification.TemplateData{Title: user.GetString("name"), Sections: sections}
+	recipient := notification.Recipient{
+		Type:     notification.RecipientUser,
+		ID:       user.Id,
+		Notifier: notification.NotifierMattermost,
+		Address:  user.GetString("mm_channel"),
+		Locale:   user.GetString("locale"),
+	}
+
+	if err := outbox.EnqueueTemplate([]notification.Recipient{recipient}, notification.TemplateDigest, data, ""); err != nil {
+		log.Printf("Digests: failed to queue digest of user %s: %v", user.Id, err)
+		return
+	}
+	recordDigest(app, notification.RecipientUser, user.Id)
+}
+
+func sendDepartmentDigest(app core.App, outbox *notification.Outbox, dept *core.Record, now time.Time) {
+	channelId := dept.GetString("mattermost_channel")
+	if channelId == "" {
+		return
+	}
+
+	sections := dept.GetStringSlice("digest_sections")
+	if len(sections) == 0 {
+		sections = digestSections
+	}
+
+	since := lastDigestAt(app, notification.RecipientDepartment, dept.Id)
+
+	content := buildDigestSections(app, jsonArrayContains("departments", dept.Id), sections, since, now)
+	if len(content) == 0 {
+		return
+	}
+
+	data := notification.TemplateData{Title: dept.GetString("name"), Sections: content}
+	recipient := notification.Recipient{
+		Type:     notification.RecipientDepartment,
+		ID:       dept.Id,
+		Notifier: notification.NotifierMattermost,
+		Address:  channelId,
+	}
+
+	if err := outbox.EnqueueTemplate([]notification.Recipient{recipient}, notification.TemplateDigest, data, ""); err != nil {
+		log.Printf("Digests: failed to queue digest of department %s: %v", dept.Id, err)
+		return
+	}
+	recordDigest(app, notification.RecipientDepartment, dept.Id)
+}
+
+// Build the requested sections for the tasks in scope, the empty ones are left out
+func buildDigestSections(app core.App, scope dbx.Expression, sections []string, since time.Time, now time.Time) []notification.DigestSection {
+	open := dbx.NotIn("status", "done", "canceled")
+	endOfWeek := startOfWeek(now).AddDate(0, 0, 7)
+
+	result := []notification.DigestSection{}
+	for _, section := range digestSections {
+		if !slices.Contains(sections, section) {
+			continue
+		}
+
+		var exprs []dbx.Expression
+		switch section {
+		case digestSectionOpen:
+			exprs = []dbx.Expression{open}
+		case digestSectionDueWeek:
+			exprs = []dbx.Expression{open, dbx.Between("due_date", dbDate(now), dbDate(endOfWeek))}
+		case digestSectionOverdue:
+			exprs = []dbx.Expression{open, dbx.NewExp("due_date != '' AND due_date < {:now}", dbx.Params{"now": dbDate(now)})}
+		case digestSectionCompleted:
+			exprs = []dbx.Expression{dbx.HashExp{"status": "done"}, dbx.NewExp("completed_at >= {:since}", dbx.Params{"since": dbDate(since)})}
+		}
+
+		tasks, err := app.FindAllRecords("tasks", append(exprs, scope)...)
+		if err != nil {
+			log.Printf("Digests: failed to load %s tasks: %v", section, err)
+			continue
+		}
+		if len(tasks) == 0 {
+			continue
+		}
+
+		data := notification.DigestSection{Name: section, Count: len(tasks)}
+		for _, task := range tasks[:min(len(tasks), digestSectionLimit)] {
+			data.Tasks = append(data.Tasks, notification.TaskTemplateData(task))
+		}
+		data.More = len(tasks) - len(data.Tasks)
+
+		result = append(result, data)
+	}
+
+	return result
+}
+
+func startOfWeek(t time.Time) time.Time {
+	offset := (int(t.Weekday()) + 6) % 7 // monday first
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+}
+
+func dbDate(t time.Time) string {
+	return mustDateTime(t).String()
+}
+
+// Time of the last digest of the target, a week ago when there was none
+func lastDigestAt(app core.App, targetType string, targetId string) time.Time {
+	records, err := app.FindRecordsByFilter(
+		"digests",
+		"target_type = {:type} && target_id = {:id}",
+		"-created",
+		1,
+		0,
+		dbx.Params{"type": targetType, "id": targetId},
+	)
+	if err != nil || len(records) == 0 {
+		return time.Now().AddDate(0, 0, -7)
+	}
+
+	return records[0].GetDateTime("created").Time()
+}
+
+func recordDigest(app core.App, targetType string, targetId string) {
+	collection, err := app.FindCollectionByNameOrId("digests")
+	if err != nil {
+		log.Printf("Digests: %v", err)
+		return
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("target_type", targetType)
+	record.Set("target_id", targetId)
+
+	if err := app.Save(record); err != nil {
+		log.Printf("Digests: failed to record digest of %s %s: %v", targetType, targetId, err)
+	}
+}
+
+// Reject department digest schedules that aren't valid cron expressions
+func validateDigestSchedule(e *core.RecordRequestEvent) error {
+	if expr := e.Record.GetString("digest_schedule"); expr != "" {
+		if _, err := cron.NewSchedule(expr); err != nil {
+			return apis.NewBadRequestError("Invalid digest schedule: "+err.Error(), nil)
+		}
+	}
+
+	return e.Next()
+}
+
+// Keep completed_at in sync with the task status
+func stampCompletedAt(task *core.Record) {
+	done := task.GetString("status") == "done"
+	wasDone := !task.IsNew() && task.Original().GetString("status") == "done"
+
+	switch {
+	case done && !wasDone:
+		task.Set("completed_at", types.NowDateTime())
+	case !done:
+		task.Set("completed_at", "")
+	}
+}
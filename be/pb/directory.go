@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+
+	"be.monk.house/notification"
+)
+
+// Default directory sync schedule, overridable with MATTERMOST_SYNC_CRON
+const defaultDirectorySyncCron = "0 * * * *"
+
+// Users fetched per Mattermost API page (the API max)
+const directoryPageSize = 200
+
+func getDirectorySyncCron() string {
+	if expr := os.Getenv("MATTERMOST_SYNC_CRON"); expr != "" {
+		return expr
+	}
+	return defaultDirectorySyncCron
+}
+
+// Whether the scheduled sync creates the accounts of the Mattermost users who
+// never signed in, MATTERMOST_SYNC_PROVISION=true. Off by default, the accounts
+// are created on the first login.
+func getDirectorySyncProvision() bool {
+	return os.Getenv("MATTERMOST_SYNC_PROVISION") == "true"
+}
+
+// Statuses of the users who can't sign in
+var blockedUserStatuses = []string{"inactive", "suspended"}
+
+func isUserBlocked(user *core.Record) bool {
+	return slices.Contains(blockedUserStatuses, user.GetString("status"))
+}
+
+// Record auth hook (sign in, token refresh, ...) rejecting the deactivated users
+func rejectBlockedUserAuth(e *core.RecordAuthRequestEvent) error {
+	if isUserBlocked(e.Record) {
+		return apis.NewForbiddenError("The account is deactivated.", nil)
+	}
+
+	return e.Next()
+}
+
+// Record hook signing a user out everywhere when they are deactivated: a new
+// token key invalidates the auth tokens issued so far
+func revokeBlockedUserTokens(e *core.RecordEvent) error {
+	if isUserBlocked(e.Record) && !isUserBlocked(e.Record.Original()) {
+		e.Record.RefreshTokenKey()
+	}
+
+	return e.Next()
+}
+
+// Outcome of a directory sync
+type DirectorySyncResult struct {
+	Created     int `json:"created"`
+	Updated     int `json:"updated"`
+	Deactivated int `json:"deactivated"`
+	Unassigned  int `json:"unassigned"`
+	// Mattermost users without an account, not provisioned
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+// Fetch a page of the Mattermost users, deactivated ones included, as the bot
+func fetchMattermostUsers(page int) ([]MattermostUser, error) {
+	config := getMattermostConfig()
+
+	usersURL := fmt.Sprintf("%s/api/v4/users?page=%d&per_page=%d", config.ServerURL, page, directoryPageSize)
+
+	req, err := http.NewRequest("GET", usersURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("MATTERMOST_BOT_TOKEN")))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API request failed with status %d", resp.StatusCode)
+	}
+
+	var users []MattermostUser
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Page through the Mattermost users: update the accounts of the active ones and
+// deactivate the accounts that were deactivated on Mattermost. With provision,
+// the accounts of the users who never signed in are created too.
+func runDirectorySync(app *pocketbase.PocketBase, outbox *notification.Outbox, provision bool) (*DirectorySyncResult, error) {
+	if os.Getenv("MATTERMOST_BOT_TOKEN") == "" {
+		return nil, fmt.Errorf("MATTERMOST_BOT_TOKEN is not set")
+	}
+
+	result := &DirectorySyncResult{}
+
+	for page := 0; ; page++ {
+		users, err := fetchMattermostUsers(page)
+		if err != nil {
+			return result, fmt.Errorf("failed to fetch users page %d: %w", page, err)
+		}
+
+		for _, mmUser := range users {
+			if mmUser.IsBot || mmUser.Email == "" {
+				continue
+			}
+
+			existing, err := findMattermostUser(app, &mmUser)
+			if err != nil {
+				result.Failed++
+				continue
+			}
+
+			if mmUser.DeleteAt != 0 {
+				if existing == nil || existing.GetString("status") == "inactive" {
+					continue
+				}
+				unassigned, err := deactivateUser(app, outbox, existing)
+				if err != nil {
+					log.Printf("Directory sync: failed to deactivate user %s: %v", existing.Id, err)
+					result.Failed++
+					continue
+				}
+				result.Deactivated++
+				result.Unassigned += unassigned
+				continue
+			}
+
+			if existing == nil && !provision {
+				result.Skipped++
+				continue
+			}
+
+			if _, err := mapMattermostUserToPocketBase(app, &mmUser); err != nil {
+				log.Printf("Directory sync: failed to upsert Mattermost user %s: %v", mmUser.ID, err)
+				result.Failed++
+				continue
+			}
+
+			if existing == nil {
+				result.Created++
+				continue
+			}
+			result.Updated++
+
+			// reactivated on Mattermost
+			if existing.GetString("status") == "inactive" {
+				existing, err = app.FindRecordById("users", existing.Id)
+				if err == nil {
+					existing.Set("status", "active")
+					err = app.Save(existing)
+				}
+				if err != nil {
+					log.Printf("Directory sync: failed to reactivate user %s: %v", mmUser.ID, err)
+				}
+			}
+		}
+
+		if len(users) < directoryPageSize {
+			break
+		}
+	}
+
+	log.Printf("Directory sync: %d created, %d updated, %d deactivated, %d task assignments removed, %d skipped, %d failed",
+		result.Created, result.Updated, result.Deactivated, result.Unassigned, result.Skipped, result.Failed)
+
+	return result, nil
+}
+
+// Mark the user inactive, which signs them out (revokeBlockedUserTokens), and remove
+// them from their open tasks, the creator of each task is alerted to reassign it.
+// Returns the number of tasks updated.
+func deactivateUser(app core.App, outbox *notification.Outbox, user *core.Record) (int, error) {
+	user.Set("status", "inactive")
+	if err := app.Save(user); err != nil {
+		return 0, err
+	}
+
+	tasks, err := app.FindAllRecords(
+		"tasks",
+		dbx.NewExp("assignees LIKE {:user}", dbx.Params{"user": "%" + user.Id + "%"}),
+		dbx.NotIn("status", "done", "canceled"),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	// the removed user can't be notified anymore, the creator gets the alert below
+	ctx := withoutTaskNotifications(context.Background())
+
+	unassigned := 0
+	for _, task := range tasks {
+		assignees := task.GetStringSlice("assignees")
+		if !slices.Contains(assignees, user.Id) {
+			continue
+		}
+
+		task.Set("assignees", slices.DeleteFunc(assignees, func(id string) bool { return id == user.Id }))
+		if err := app.SaveWithContext(ctx, task); err != nil {
+			log.Printf("Directory sync: failed to unassign user %s from task %s: %v", user.Id, task.Id, err)
+			continue
+		}
+		unassigned++
+
+		creatorId := task.GetString("createdBy")
+		if creatorId == "" || creatorId == user.Id {
+			continue
+		}
+
+		recipients, unreachable := resolveTaskRecipients(app, notification.EventTaskAssigneeDeactivated, []string{creatorId}, nil)
+		for _, r := range unreachable {
+			log.Printf("Task %s: %s %s has no notification address and was not notified", task.Id, r.Type, r.ID)
+		}
+		if len(recipients) == 0 {
+			continue
+		}
+
+		data := notification.TaskTemplateData(task)
+		data.User = user.GetString("name")
+		if err := outbox.EnqueueTemplate(recipients, notification.EventTaskAssigneeDeactivated, data, task.Id); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return unassigned, nil
+}
+
+// Run the directory sync now, ?provision=true also creates the missing accounts
+func handleDirectorySync(c *core.RequestEvent, app *pocketbase.PocketBase, outbox *notification.Outbox) error {
+	provision := c.Request.URL.Query().Get("provision") == "true"
+
+	result, err := runDirectorySync(app, outbox, provision)
+	if err != nil {
+		return c.JSON(502, map[string]any{
+			"error":  err.Error(),
+			"result": result,
+		})
+	}
+
+	return c.JSON(200, map[string]any{
+		"success": true,
+		"result":  result,
+	})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/search"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/xuri/excelize/v2"
+)
+
+// Tasks loaded per query while exporting
+const exportBatchSize = 500
+
+var exportHeader = []string{"id", "title", "description", "status", "label", "due_date", "assignees", "departments", "created", "completed_at"}
+
+// Load the tasks matching the query in batches, with the assignee names and department codes
+func eachTaskBatch(app core.App, query *dbx.SelectQuery, fn func(tasks []*core.Record, names map[string]string, codes map[string]string) error) error {
+	for offset := 0; ; offset += exportBatchSize {
+		tasks := []*core.Record{}
+		if err := query.Limit(exportBatchSize).Offset(int64(offset)).All(&tasks); err != nil {
+			return err
+		}
+		if len(tasks) == 0 {
+			return nil
+		}
+
+		userIds, departmentIds := []string{}, []string{}
+		for _, task := range tasks {
+			userIds = append(userIds, task.GetStringSlice("assignees")...)
+			departmentIds = append(departmentIds, task.GetStringSlice("departments")...)
+		}
+
+		names := map[string]string{}
+		if users, err := app.FindRecordsByIds("users", userIds); err == nil {
+			for _, user := range users {
+				names[user.Id] = user.GetString("name")
+			}
+		}
+
+		codes := map[string]string{}
+		if departments, err := app.FindRecordsByIds("departments", departmentIds); err == nil {
+			for _, dept := range departments {
+				codes[dept.Id] = dept.GetString("code")
+			}
+		}
+
+		if err := fn(tasks, names, codes); err != nil {
+			return err
+		}
+
+		if len(tasks) < exportBatchSize {
+			return nil
+		}
+	}
+}
+
+func lookupAll(ids []string, values map[string]string) []string {
+	result := []string{}
+	for _, id := range ids {
+		if value := values[id]; value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+func exportDate(dt types.DateTime) string {
+	if dt.IsZero() {
+		return ""
+	}
+	return dt.String()
+}
+
+func exportRow(task *core.Record, names map[string]string, codes map[string]string) []string {
+	return []string{
+		task.Id,
+		task.GetString("title"),
+		stripHTML(task.GetString("description")),
+		task.GetString("status"),
+		task.GetString("label"),
+		exportDate(task.GetDateTime("due_date")),
+		strings.Join(lookupAll(task.GetStringSlice("assignees"), names), ", "),
+		strings.Join(lookupAll(task.GetStringSlice("departments"), codes), ", "),
+		exportDate(task.GetDateTime("created")),
+		exportDate(task.GetDateTime("completed_at")),
+	}
+}
+
+// Prefix the cells that spreadsheets would run as formulas (starting with =, +, -, @, tab or CR)
+// with a quote so they are shown as text
+func csvSafeRow(values []string) []string {
+	safe := make([]string, len(values))
+	for i, value := range values {
+		if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+			value = "'" + value
+		}
+		safe[i] = value
+	}
+	return safe
+}
+
+// Build the tasks query of the request: the collection list rule of the auth
+// and the "filter"/"sort" query params, in the same syntax as the records list API.
+func exportTasksQuery(c *core.RequestEvent, app core.App) (*dbx.SelectQuery, error) {
+	collection, err := app.FindCollectionByNameOrId("tasks")
+	if err != nil {
+		return nil, err
+	}
+
+	requestInfo, err := c.RequestInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	if collection.ListRule == nil && !requestInfo.HasSuperuserAuth() {
+		return nil, fmt.Errorf("only superusers can list tasks")
+	}
+
+	resolver := core.NewRecordFieldResolver(app, collection, requestInfo, true)
+	query := app.RecordQuery(collection)
+
+	if !requestInfo.HasSuperuserAuth() && *collection.ListRule != "" {
+		expr, err := search.FilterData(*collection.ListRule).BuildExpr(resolver)
+		if err != nil {
+			return nil, err
+		}
+		query.AndWhere(expr)
+	}
+
+	// the rule can use hidden fields, the filter and sort of the request can't
+	// (eg. guessing the calendar_token of the assignees)
+	resolver.SetAllowHiddenFields(requestInfo.HasSuperuserAuth())
+
+	if filter := c.Request.URL.Query().Get("filter"); filter != "" {
+		expr, err := search.FilterData(filter).BuildExpr(resolver)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+		query.AndWhere(expr)
+	}
+
+	sort := c.Request.URL.Query().Get("sort")
+	if sort == "" {
+		sort = "-created"
+	}
+	for _, field := range search.ParseSortFromString(sort) {
+		expr, err := field.BuildExpr(resolver)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sort: %w", err)
+		}
+		query.AndOrderBy(expr)
+	}
+	// stable batches
+	query.AndOrderBy(collection.Name + ".id ASC")
+
+	if err := resolver.UpdateQuery(query); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+// Export the tasks visible to the auth as CSV, XLSX or iCalendar (format query param).
+// Only the tasks with a due date are exported to iCalendar.
+func handleExportTasks(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	format := c.Request.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" && format != "ics" {
+		return c.JSON(400, map[string]string{"error": "format must be csv, xlsx or ics"})
+	}
+
+	query, err := exportTasksQuery(c, app)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	filename := fmt.Sprintf("tasks-%s.%s", time.Now().Format("20060102"), format)
+	header := c.Response.Header()
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	switch format {
+	case "csv":
+		header.Set("Content-Type", "text/csv; charset=utf-8")
+		c.Response.WriteHeader(200)
+
+		// byte order mark so excel reads UTF-8
+		c.Response.Write([]byte("\ufeff"))
+
+		writer := csv.NewWriter(c.Response)
+		writer.Write(exportHeader)
+		err = eachTaskBatch(app, query, func(tasks []*core.Record, names map[string]string, codes map[string]string) error {
+			for _, task := range tasks {
+				writer.Write(csvSafeRow(exportRow(task, names, codes)))
+			}
+			writer.Flush()
+			return writer.Error()
+		})
+
+	case "xlsx":
+		workbook := excelize.NewFile()
+		defer workbook.Close()
+
+		var stream *excelize.StreamWriter
+		stream, err = workbook.NewStreamWriter("Sheet1")
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": "failed to create workbook"})
+		}
+
+		row := 1
+		writeRow := func(values []string) error {
+			cells := make([]any, len(values))
+			for i, value := range values {
+				cells[i] = value
+			}
+			cell, _ := excelize.CoordinatesToCellName(1, row)
+			row++
+			return stream.SetRow(cell, cells)
+		}
+
+		writeRow(exportHeader)
+		err = eachTaskBatch(app, query, func(tasks []*core.Record, names map[string]string, codes map[string]string) error {
+			for _, task := range tasks {
+				if err := writeRow(exportRow(task, names, codes)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			err = stream.Flush()
+		}
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": "failed to export tasks"})
+		}
+
+		header.Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		c.Response.WriteHeader(200)
+		_, err = workbook.WriteTo(c.Response)
+
+	case "ics":
+		header.Set("Content-Type", "text/calendar; charset=utf-8")
+		c.Response.WriteHeader(200)
+
+		ics := newICSWriter(c.Response, calendarName(c.Auth.GetString("locale"), ""))
+		err = eachTaskBatch(app, query, func(tasks []*core.Record, names map[string]string, codes map[string]string) error {
+			for _, task := range tasks {
+				ics.WriteTask(task, lookupAll(task.GetStringSlice("departments"), codes))
+			}
+			return nil
+		})
+		if err == nil {
+			err = ics.Close()
+		}
+	}
+
+	// the response has already started, the export is cut short
+	if err != nil {
+		log.Printf("Task export (%s) failed: %v", format, err)
+	}
+
+	return nil
+}
+
+// URL of the user's calendar feed
+func calendarFeedURL(token string) string {
+	return fmt.Sprintf("%s/api/calendar/%s.ics", os.Getenv("POCKETBASE_SERVER_URL"), token)
+}
+
+// Return the calendar feed URL of the auth user, creating the feed token on first use.
+// rotate replaces the token, the previous URL stops working.
+func handleCalendarFeedURL(c *core.RequestEvent, app *pocketbase.PocketBase, rotate bool) error {
+	user, err := app.FindRecordById("users", c.Auth.Id)
+	if err != nil {
+		return c.JSON(404, map[string]string{"error": "user not found"})
+	}
+
+	if rotate || user.GetString("calendar_token") == "" {
+		user.Set("calendar_token", security.RandomString(40))
+		if err := app.SaveWithContext(withAuditActor(context.Background(), requestAuditActor(c)), user); err != nil {
+			return c.JSON(500, map[string]string{"error": "failed to create the calendar feed"})
+		}
+	}
+
+	return c.JSON(200, map[string]string{"url": calendarFeedURL(user.GetString("calendar_token"))})
+}
+
+// Serve the deadlines of a user as an iCalendar feed, the secret token in the URL identifies the user
+func handleCalendarFeed(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	token := strings.TrimSuffix(c.Request.PathValue("token"), ".ics")
+	if token == "" {
+		return c.JSON(404, map[string]string{"error": "feed not found"})
+	}
+
+	user, err := app.FindFirstRecordByFilter("users", "calendar_token = {:token}", dbx.Params{"token": token})
+	if err != nil {
+		return c.JSON(404, map[string]string{"error": "feed not found"})
+	}
+
+	query := app.RecordQuery("tasks").
+		AndWhere(jsonArrayContains("assignees", user.Id)).
+		AndWhere(dbx.NewExp("due_date != ''")).
+		AndWhere(dbx.Not(dbx.HashExp{"status": "canceled"})).
+		OrderBy("due_date ASC", "id ASC")
+
+	c.Response.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	c.Response.WriteHeader(200)
+
+	ics := newICSWriter(c.Response, calendarName(user.GetString("locale"), user.GetString("name")))
+	err = eachTaskBatch(app, query, func(tasks []*core.Record, names map[string]string, codes map[string]string) error {
+		for _, task := range tasks {
+			ics.WriteTask(task, lookupAll(task.GetStringSlice("departments"), codes))
+		}
+		return nil
+	})
+	if err == nil {
+		err = ics.Close()
+	}
+	if err != nil {
+		log.Printf("Calendar feed of user %s failed: %v", user.Id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func newExportRequest(app core.App, auth *core.Record, filter string) *core.RequestEvent {
+	e := &core.RequestEvent{App: app, Auth: auth}
+	e.Request = httptest.NewRequest("GET", "/api/tasks/export?filter="+url.QueryEscape(filter), nil)
+	e.Response = httptest.NewRecorder()
+	return e
+}
+
+func TestExportTasksQueryHiddenFields(t *testing.T) {
+	app := newTestApp(t)
+	user := newTestUser(t, app, "an@example.org")
+
+	superusers, err := app.FindCollectionByNameOrId(core.CollectionNameSuperusers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	superuser := core.NewRecord(superusers)
+	superuser.SetEmail("admin@example.org")
+	superuser.SetPassword("password123")
+	if err := app.Save(superuser); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := "assignees.calendar_token ~ 'a'"
+
+	if _, err := exportTasksQuery(newExportRequest(app, user, filter), app); err == nil {
+		t.Fatal("expected the filter on a hidden field to be rejected for a user")
+	}
+
+	if _, err := exportTasksQuery(newExportRequest(app, user, "title ~ 'a'"), app); err != nil {
+		t.Fatalf("expected the filter on a visible field to be accepted, got %v", err)
+	}
+
+	if _, err := exportTasksQuery(newExportRequest(app, superuser, filter), app); err != nil {
+		t.Fatalf("expected the filter on a hidden field to be accepted for a superuser, got %v", err)
+	}
+}
+
+func TestCSVSafeRow(t *testing.T) {
+	got := csvSafeRow([]string{"=HYPERLINK(\"x\")", "+1", "-2", "@SUM(A1)", "\tcmd", "Báo cáo", "", "2026-10-20 03:00:00.000Z"})
+	want := []string{"'=HYPERLINK(\"x\")", "'+1", "'-2", "'@SUM(A1)", "'\tcmd", "Báo cáo", "", "2026-10-20 03:00:00.000Z"}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("cell %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
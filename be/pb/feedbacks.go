@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"be.monk.house/notification"
+)
+
+var errAmbiguousThread = errors.New("the thread is shared by several tasks")
+
+var feedbackTypeLabels = map[string]string{
+	"comment": "Bình luận",
+	"report":  "Báo cáo",
+}
+
+// Post a new feedback as a reply in the Mattermost thread of its task announcement,
+// through the outbox as the sender with their Mattermost token, else as the bot.
+// Feedbacks that came from Mattermost already have their post.
+func postFeedbackReply(app core.App, outbox *notification.Outbox, feedback *core.Record) {
+	if feedback.GetString("mm_post_id") != "" {
+		return
+	}
+
+	task, err := app.FindRecordById("tasks", feedback.GetString("task"))
+	if err != nil || task.GetString("mm_post_id") == "" {
+		return
+	}
+
+	label := feedbackTypeLabels[feedback.GetString("type")]
+	if label == "" {
+		label = feedbackTypeLabels["comment"]
+	}
+	label += threadTaskRef(app, task)
+
+	sender := "Ẩn danh"
+	if user, err := app.FindRecordById("users", feedback.GetString("sender")); err == nil {
+		sender = user.GetString("name")
+	}
+
+	message := fmt.Sprintf("**[%s] %s**\n%s", label, sender, feedback.GetString("message"))
+
+	err = outbox.EnqueueFeedbackReply(
+		task.GetString("mm_channel_id"),
+		task.GetString("mm_post_id"),
+		message,
+		task.Id,
+		feedback.Id,
+		feedback.GetString("sender"),
+	)
+	if err != nil {
+		log.Printf("Feedback %s: failed to queue thread reply: %v", feedback.Id, err)
+	}
+}
+
+// Name the task in a thread shared by the tasks created in bulk, empty otherwise
+func threadTaskRef(app core.App, task *core.Record) string {
+	shared, err := app.CountRecords("tasks", dbx.HashExp{"mm_post_id": task.GetString("mm_post_id")})
+	if err != nil || shared < 2 {
+		return ""
+	}
+
+	return fmt.Sprintf(" - %s %s", task.Id, task.GetString("title"))
+}
+
+// Task a thread reply belongs to. The tasks created in bulk share their
+// announcement, a reply in that thread names the task by its id.
+func findThreadTask(app core.App, rootId string, text string) (*core.Record, error) {
+	tasks, err := app.FindAllRecords("tasks", dbx.HashExp{"mm_post_id": rootId})
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 1 {
+		return tasks[0], nil
+	}
+
+	text = strings.ToUpper(text)
+	for _, task := range tasks {
+		if strings.Contains(text, strings.ToUpper(task.Id)) {
+			return task, nil
+		}
+	}
+	if len(tasks) > 1 {
+		return nil, errAmbiguousThread
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// Payload of a Mattermost outgoing webhook
+type MattermostOutgoingWebhook struct {
+	Token     string `form:"token" json:"token"`
+	ChannelID string `form:"channel_id" json:"channel_id"`
+	PostID    string `form:"post_id" json:"post_id"`
+	UserID    string `form:"user_id" json:"user_id"`
+	UserName  string `form:"user_name" json:"user_name"`
+	Text      string `form:"text" json:"text"`
+}
+
+// Receive the posts of the task channels from a Mattermost outgoing webhook and
+// store the replies to a task announcement as feedbacks of that task.
+// The webhook is checked against MATTERMOST_OUTGOING_TOKEN.
+func handleMattermostThreadReply(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	var payload MattermostOutgoingWebhook
+	if err := c.BindBody(&payload); err != nil {
+		return c.JSON(400, map[string]string{"error": "invalid request"})
+	}
+
+	expected := os.Getenv("MATTERMOST_OUTGOING_TOKEN")
+	if expected == "" || subtle.ConstantTimeCompare([]byte(payload.Token), []byte(expected)) != 1 {
+		return c.JSON(401, map[string]string{"error": "invalid token"})
+	}
+
+	// an empty response doesn't post anything back to the channel
+	ignore := func() error {
+		return c.JSON(200, map[string]string{})
+	}
+
+	// our own thread replies
+	if payload.UserID == os.Getenv("MATTERMOST_BOT_ID") || strings.TrimSpace(payload.Text) == "" {
+		return ignore()
+	}
+
+	existing, _ := app.FindFirstRecordByFilter("feedbacks", "mm_post_id = {:post}", dbx.Params{"post": payload.PostID})
+	if existing != nil {
+		return ignore()
+	}
+
+	// the outgoing webhook doesn't tell which thread the post belongs to
+	post, err := notification.GetMattermostPost(payload.PostID)
+	if err != nil {
+		log.Printf("Thread reply: failed to load post %s: %v", payload.PostID, err)
+		return ignore()
+	}
+	if post.RootID == "" || post.Props.FeedbackID != "" {
+		return ignore()
+	}
+
+	task, err := findThreadTask(app, post.RootID, payload.Text)
+	if errors.Is(err, errAmbiguousThread) {
+		return c.JSON(200, map[string]string{
+			"text":          "Hãy ghi mã công việc (vd. PQQ00001) trong trả lời để gắn phản hồi vào đúng công việc.",
+			"response_type": "comment",
+		})
+	}
+	if err != nil {
+		return ignore()
+	}
+
+	collection, err := app.FindCollectionByNameOrId("feedbacks")
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "feedbacks collection not found"})
+	}
+
+	feedback := core.NewRecord(collection)
+	feedback.Set("task", task.Id)
+	feedback.Set("type", "comment")
+	feedback.Set("message", payload.Text)
+	feedback.Set("timestamp", types.NowDateTime())
+	feedback.Set("mm_post_id", payload.PostID)
+
+	// users are linked to their Mattermost account on first login
+	ctx := context.Background()
+	if user, err := findUserByMattermostId(app, payload.UserID); err == nil {
+		feedback.Set("sender", user.Id)
+		ctx = withAuditActor(ctx, userAuditActor(user))
+	}
+
+	if err := app.SaveWithContext(ctx, feedback); err != nil {
+		log.Printf("Thread reply: failed to save feedback for post %s: %v", payload.PostID, err)
+		return c.JSON(500, map[string]string{"error": "failed to save feedback"})
+	}
+
+	return ignore()
+}
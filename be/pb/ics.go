@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+
+	"be.monk.house/notification"
+)
+
+const icsTimeLayout = "20060102T150405Z"
+
+var icsStatuses = map[string]string{
+	"backlog":     "NEEDS-ACTION",
+	"todo":        "NEEDS-ACTION",
+	"in_progress": "IN-PROCESS",
+	"done":        "COMPLETED",
+	"canceled":    "CANCELLED",
+}
+
+// Calendar names by language
+var calendarNames = map[string]string{
+	"vi": "Công việc",
+	"en": "Tasks",
+}
+
+// Name of the task calendar in the locale, or the default locale, followed by the owner name when given
+func calendarName(locale string, owner string) string {
+	name := calendarNames["vi"]
+	for _, candidate := range []string{locale, notification.DefaultLocale()} {
+		lang, _, _ := strings.Cut(strings.ToLower(candidate), "-")
+		if localized, ok := calendarNames[lang]; ok {
+			name = localized
+			break
+		}
+	}
+
+	if owner != "" {
+		name += " - " + owner
+	}
+	return name
+}
+
+// Writes an iCalendar file with one VTODO per task (RFC 5545)
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func newICSWriter(w io.Writer, name string) *icsWriter {
+	ics := &icsWriter{w: w}
+	ics.line("BEGIN:VCALENDAR")
+	ics.line("VERSION:2.0")
+	ics.line("PRODID:-//monk.house//tasks//VI")
+	ics.line("CALSCALE:GREGORIAN")
+	ics.line("X-WR-CALNAME:" + icsEscape(name))
+	return ics
+}
+
+// Write a content line, folded at 75 octets without splitting UTF-8 characters
+func (ics *icsWriter) line(content string) {
+	if ics.err != nil {
+		return
+	}
+
+	var b strings.Builder
+	length := 0
+	for _, r := range content {
+		size := len(string(r))
+		if length+size > 75 {
+			b.WriteString("\r\n ")
+			length = 1
+		}
+		b.WriteRune(r)
+		length += size
+	}
+	b.WriteString("\r\n")
+
+	_, ics.err = io.WriteString(ics.w, b.String())
+}
+
+// Add the task as a VTODO, tasks without a due date are skipped
+func (ics *icsWriter) WriteTask(task *core.Record, departmentCodes []string) {
+	due := task.GetDateTime("due_date")
+	if due.IsZero() {
+		return
+	}
+
+	ics.line("BEGIN:VTODO")
+	ics.line(fmt.Sprintf("UID:%s@monk.house", task.Id))
+	ics.line("DTSTAMP:" + time.Now().UTC().Format(icsTimeLayout))
+	ics.line("LAST-MODIFIED:" + task.GetDateTime("updated").Time().UTC().Format(icsTimeLayout))
+	ics.line("SUMMARY:" + icsEscape(task.GetString("title")))
+	ics.line("DUE:" + due.Time().UTC().Format(icsTimeLayout))
+	if status, ok := icsStatuses[task.GetString("status")]; ok {
+		ics.line("STATUS:" + status)
+	}
+	if completed := task.GetDateTime("completed_at"); !completed.IsZero() {
+		ics.line("COMPLETED:" + completed.Time().UTC().Format(icsTimeLayout))
+	}
+	if description := task.GetString("description"); description != "" {
+		ics.line("DESCRIPTION:" + icsEscape(stripHTML(description)))
+	}
+	if len(departmentCodes) > 0 {
+		escaped := make([]string, 0, len(departmentCodes))
+		for _, code := range departmentCodes {
+			escaped = append(escaped, icsEscape(code))
+		}
+		ics.line("CATEGORIES:" + strings.Join(escaped, ","))
+	}
+	ics.line("URL:" + taskDetailLink(task.Id))
+	ics.line("END:VTODO")
+}
+
+func (ics *icsWriter) Close() error {
+	ics.line("END:VCALENDAR")
+	return ics.err
+}
+
+func icsEscape(value string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(value)
+}
+
+// Plain text of the task description editor HTML
+func stripHTML(value string) string {
+	var b strings.Builder
+	inTag := false
+	for _, r := range value {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+		case !inTag:
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(html.UnescapeString(b.String()))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestICSEscape(t *testing.T) {
+	got := icsEscape("a\\b; c, d\r\ne\nf")
+	want := `a\\b\; c\, d\ne\nf`
+	if got != want {
+		t.Fatalf("icsEscape = %q, want %q", got, want)
+	}
+}
+
+func TestICSLineFolding(t *testing.T) {
+	var b strings.Builder
+	ics := &icsWriter{w: &b}
+
+	// 2 byte characters, the 75 octet limit falls inside one of them
+	content := "SUMMARY:" + strings.Repeat("ư", 100)
+	ics.line(content)
+	if ics.err != nil {
+		t.Fatal(ics.err)
+	}
+
+	out := b.String()
+	if !strings.HasSuffix(out, "\r\n") {
+		t.Fatalf("expected the line to end with CRLF, got %q", out)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+	if len(lines) < 3 {
+		t.Fatalf("expected the line to be folded, got %d lines", len(lines))
+	}
+
+	unfolded := lines[0]
+	for i, line := range lines {
+		if len(line) > 75 {
+			t.Errorf("line %d has %d octets", i, len(line))
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("line %d splits a UTF-8 character: %q", i, line)
+		}
+		if i > 0 {
+			if !strings.HasPrefix(line, " ") {
+				t.Errorf("continuation line %d doesn't start with a space", i)
+			}
+			unfolded += strings.TrimPrefix(line, " ")
+		}
+	}
+
+	if unfolded != content {
+		t.Fatalf("unfolded line = %q, want %q", unfolded, content)
+	}
+}
+
+func TestICSShortLineNotFolded(t *testing.T) {
+	var b strings.Builder
+	ics := &icsWriter{w: &b}
+
+	ics.line("VERSION:2.0")
+	if got := b.String(); got != "VERSION:2.0\r\n" {
+		t.Fatalf("line = %q", got)
+	}
+}
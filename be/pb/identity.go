@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+var errIdentityConflict = errors.New("the Mattermost account conflicts with another user")
+
+// Fields of the Mattermost identity, only changed by the login, the sync and superusers
+var identityFields = []string{"mm_user_id", "identity_conflict", "auth_source"}
+
+// Records API hook: a user can't link their account to another Mattermost account
+var protectIdentityFields = superuserOnlyFields(identityFields...)
+
+// Find the user linked to a Mattermost account id. Users created by the
+// Mattermost login before the link have the Mattermost id as record id.
+func findUserByMattermostId(app core.App, mmUserId string) (*core.Record, error) {
+	if mmUserId == "" {
+		return nil, sql.ErrNoRows
+	}
+
+	record, err := app.FindFirstRecordByFilter("users", "mm_user_id = {:id}", dbx.Params{"id": mmUserId})
+	if err == nil {
+		return record, nil
+	}
+
+	record, err = app.FindRecordById("users", mmUserId)
+	if err != nil {
+		return nil, err
+	}
+	if linked := record.GetString("mm_user_id"); linked != "" && linked != mmUserId {
+		return nil, sql.ErrNoRows
+	}
+
+	return record, nil
+}
+
+// Find the user of a Mattermost account: by its id, then by email for the
+// accounts not linked yet. Returns nil when there is no user. An email already
+// linked to another Mattermost account is flagged and returns errIdentityConflict.
+func findMattermostUser(app core.App, mmUser *MattermostUser) (*core.Record, error) {
+	if record, err := findUserByMattermostId(app, mmUser.ID); err == nil {
+		return record, nil
+	}
+
+	if mmUser.Email == "" {
+		return nil, nil
+	}
+
+	record, err := app.FindFirstRecordByFilter("users", "email = {:email}", dbx.Params{"email": mmUser.Email})
+	if err != nil {
+		return nil, nil
+	}
+
+	if linked := record.GetString("mm_user_id"); linked != "" && linked != mmUser.ID {
+		flagIdentityConflict(app, record, fmt.Sprintf("email %s is also used by the Mattermost account %s", mmUser.Email, mmUser.ID))
+		return nil, errIdentityConflict
+	}
+
+	return record, nil
+}
+
+// Link the user to the Mattermost account and follow its email changes. An email
+// taken by another user is not changed, the conflict is flagged on the user until
+// the email can be updated or a superuser clears it.
+func linkMattermostUser(app core.App, user *core.Record, mmUser *MattermostUser) {
+	user.Set("mm_user_id", mmUser.ID)
+
+	if mmUser.Email == "" || user.GetString("email") == mmUser.Email {
+		return
+	}
+
+	other, err := app.FindFirstRecordByFilter(
+		"users",
+		"email = {:email} && id != {:id}",
+		dbx.Params{"email": mmUser.Email, "id": user.Id},
+	)
+	if err == nil {
+		reason := fmt.Sprintf("Mattermost email changed to %s, already used by user %s", mmUser.Email, other.Id)
+		log.Printf("Identity conflict of user %s: %s", user.Id, reason)
+		user.Set("identity_conflict", reason)
+		return
+	}
+
+	user.Set("email", mmUser.Email)
+	user.Set("identity_conflict", "")
+}
+
+func flagIdentityConflict(app core.App, user *core.Record, reason string) {
+	if user.GetString("identity_conflict") == reason {
+		return
+	}
+
+	log.Printf("Identity conflict of user %s: %s", user.Id, reason)
+
+	user.Set("identity_conflict", reason)
+	if err := app.Save(user); err != nil {
+		log.Printf("Failed to flag the identity conflict of user %s: %v", user.Id, err)
+	}
+}
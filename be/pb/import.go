@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/xuri/excelize/v2"
+
+	"be.monk.house/notification"
+)
+
+// Max size of an uploaded import file
+const importMaxFileSize = 10 << 20
+
+// Room for the multipart headers and the other form fields around the file
+const importMaxFormOverhead = 1 << 20
+
+// Accepted column headers (lowercased) for each task field
+var importColumns = map[string][]string{
+	"title":       {"title", "tiêu đề", "tên công việc"},
+	"description": {"description", "mô tả"},
+	"status":      {"status", "trạng thái"},
+	"label":       {"label", "nhãn"},
+	"due_date":    {"due_date", "due date", "hạn", "hạn hoàn thành"},
+	"assignees":   {"assignees", "người thực hiện"},
+	"departments": {"departments", "phòng ban"},
+}
+
+// Accepted due date formats, in the server timezone unless the value has one
+var importDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"02/01/2006 15:04",
+	"02/01/2006",
+	"01-02-06", // excel default date format
+}
+
+// Result of one imported row, Row is the line number in the file (the header is row 1)
+type ImportRow struct {
+	Row    int           `json:"row"`
+	Task   BulkTaskInput `json:"task"`
+	Errors []string      `json:"errors,omitempty"`
+}
+
+// Read the rows of a CSV or XLSX file, the first row is the header
+func readImportFile(name string, file io.Reader) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		return reader.ReadAll()
+	case ".xlsx":
+		workbook, err := excelize.OpenReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer workbook.Close()
+
+		sheets := workbook.GetSheetList()
+		if len(sheets) == 0 {
+			return nil, fmt.Errorf("the workbook has no sheet")
+		}
+		return workbook.GetRows(sheets[0])
+	default:
+		return nil, fmt.Errorf("unsupported file type %q, use .csv or .xlsx", filepath.Ext(name))
+	}
+}
+
+// Map the task fields to their column index from the header row
+func mapImportColumns(header []string) (map[string]int, error) {
+	columns := map[string]int{}
+	for i, name := range header {
+		// excel adds a byte order mark to UTF-8 CSV files
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		for field, aliases := range importColumns {
+			if slices.Contains(aliases, name) {
+				columns[field] = i
+			}
+		}
+	}
+
+	if _, ok := columns["title"]; !ok {
+		return nil, fmt.Errorf("missing title column")
+	}
+
+	return columns, nil
+}
+
+// Split a cell holding several values, eg. "an@x.io, @binh"
+func splitImportList(value string) []string {
+	items := []string{}
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' || r == '\n' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Accept status codes and their labels in any locale
+func parseImportStatus(value string) (string, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, status := range []string{"backlog", "todo", "in_progress", "done", "canceled"} {
+		if value == status ||
+			value == strings.ToLower(notification.StatusLabel(status, "vi")) ||
+			value == strings.ToLower(notification.StatusLabel(status, "en")) {
+			return status, true
+		}
+	}
+	return "", false
+}
+
+func parseImportDate(value string) (types.DateTime, error) {
+	for _, layout := range importDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return types.ParseDateTime(t)
+		}
+	}
+	return types.DateTime{}, fmt.Errorf("invalid due date %q", value)
+}
+
+// Validate the rows and resolve the assignees (email or username) and departments (code)
+func validateImportRows(app core.App, rows [][]string, columns map[string]int) []*ImportRow {
+	userIds := map[string]string{}
+	findUser := func(ref string) (string, bool) {
+		ref = strings.TrimPrefix(ref, "@")
+		if id, ok := userIds[ref]; ok {
+			return id, id != ""
+		}
+		user, err := app.FindFirstRecordByFilter("users", "email = {:ref} || username = {:ref}", dbx.Params{"ref": ref})
+		userIds[ref] = ""
+		if err == nil {
+			userIds[ref] = user.Id
+		}
+		return userIds[ref], userIds[ref] != ""
+	}
+
+	departmentIds := map[string]string{}
+	findDepartment := func(code string) (string, bool) {
+		if id, ok := departmentIds[code]; ok {
+			return id, id != ""
+		}
+		dept, err := app.FindFirstRecordByFilter("departments", "code = {:code}", dbx.Params{"code": code})
+		departmentIds[code] = ""
+		if err == nil {
+			departmentIds[code] = dept.Id
+		}
+		return departmentIds[code], departmentIds[code] != ""
+	}
+
+	results := []*ImportRow{}
+	for i, cells := range rows {
+		cell := func(field string) string {
+			index, ok := columns[field]
+			if !ok || index >= len(cells) {
+				return ""
+			}
+			return strings.TrimSpace(cells[index])
+		}
+
+		// skip blank lines
+		if strings.TrimSpace(strings.Join(cells, "")) == "" {
+			continue
+		}
+
+		result := &ImportRow{Row: i + 2}
+		result.Task = BulkTaskInput{
+			Title:       cell("title"),
+			Description: cell("description"),
+			Label:       cell("label"),
+			Status:      "todo",
+			Assignees:   []string{},
+			Departments: []string{},
+		}
+
+		if result.Task.Title == "" {
+			result.Errors = append(result.Errors, "title is required")
+		}
+
+		if value := cell("status"); value != "" {
+			status, ok := parseImportStatus(value)
+			if !ok {
+				result.Errors = append(result.Errors, fmt.Sprintf("unknown status %q", value))
+			}
+			result.Task.Status = status
+		}
+
+		if value := cell("due_date"); value != "" {
+			dueDate, err := parseImportDate(value)
+			if err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			}
+			result.Task.DueDate = dueDate.String()
+		}
+
+		for _, ref := range splitImportList(cell("assignees")) {
+			id, ok := findUser(ref)
+			if !ok {
+				result.Errors = append(result.Errors, fmt.Sprintf("unknown user %q", ref))
+				continue
+			}
+			if !slices.Contains(result.Task.Assignees, id) {
+				result.Task.Assignees = append(result.Task.Assignees, id)
+			}
+		}
+
+		for _, code := range splitImportList(cell("departments")) {
+			id, ok := findDepartment(code)
+			if !ok {
+				result.Errors = append(result.Errors, fmt.Sprintf("unknown department %q", code))
+				continue
+			}
+			if !slices.Contains(result.Task.Departments, id) {
+				result.Task.Departments = append(result.Task.Departments, id)
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// Import tasks from a CSV or XLSX file ("file" form field).
+// Every row is validated first, nothing is created when a row is invalid or
+// when dry_run is set, the per-row report shows what would be imported.
+func handleImportTasks(c *core.RequestEvent, app *pocketbase.PocketBase, outbox *notification.Outbox) error {
+	// stop reading oversized uploads instead of spooling them to disk
+	c.Request.Body = http.MaxBytesReader(c.Response, c.Request.Body, importMaxFileSize+importMaxFormOverhead)
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return c.JSON(400, map[string]string{"error": "file is too large"})
+		}
+		return c.JSON(400, map[string]string{"error": "missing file"})
+	}
+	defer file.Close()
+
+	if header.Size > importMaxFileSize {
+		return c.JSON(400, map[string]string{"error": "file is too large"})
+	}
+
+	dryRun := c.Request.FormValue("dry_run") == "true" || c.Request.URL.Query().Get("dry_run") == "true"
+
+	rows, err := readImportFile(header.Filename, file)
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": "failed to read file", "details": err.Error()})
+	}
+	if len(rows) < 2 {
+		return c.JSON(400, map[string]string{"error": "the file has no task rows"})
+	}
+
+	columns, err := mapImportColumns(rows[0])
+	if err != nil {
+		return c.JSON(400, map[string]string{"error": err.Error()})
+	}
+
+	// blank lines are not counted
+	results := validateImportRows(app, rows[1:], columns)
+	if len(results) == 0 {
+		return c.JSON(400, map[string]string{"error": "the file has no task rows"})
+	}
+	if len(results) > bulkTaskLimit {
+		return c.JSON(400, map[string]string{"error": fmt.Sprintf("at most %d tasks can be imported at once", bulkTaskLimit)})
+	}
+
+	invalid := 0
+	for _, result := range results {
+		if len(result.Errors) > 0 {
+			invalid++
+		}
+	}
+
+	report := func(status int, imported bool) error {
+		return c.JSON(status, map[string]any{
+			"success":  invalid == 0,
+			"dry_run":  dryRun,
+			"imported": imported,
+			"total":    len(results),
+			"invalid":  invalid,
+			"rows":     results,
+		})
+	}
+
+	if invalid > 0 {
+		return report(400, false)
+	}
+	if dryRun {
+		return report(200, false)
+	}
+
+	inputs := make([]BulkTaskInput, 0, len(results))
+	for _, result := range results {
+		inputs = append(inputs, result.Task)
+	}
+
+	tasks, rowErrors, err := createTasksInBulk(withAuditActor(context.Background(), requestAuditActor(c)), app, inputs, c.Auth)
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to import tasks"})
+	}
+	if len(rowErrors) > 0 {
+		for _, rowError := range rowErrors {
+			results[rowError.Row].Errors = append(results[rowError.Row].Errors, rowError.Error)
+		}
+		invalid = len(rowErrors)
+		return report(400, false)
+	}
+
+	notifyTasksCreatedInBulk(app, outbox, tasks)
+
+	return report(200, true)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseImportDate(t *testing.T) {
+	cases := map[string]time.Time{
+		"2026-10-20T03:00:00Z": time.Date(2026, 10, 20, 3, 0, 0, 0, time.UTC),
+		"2026-10-20 09:30:15":  time.Date(2026, 10, 20, 9, 30, 15, 0, time.Local),
+		"2026-10-20 09:30":     time.Date(2026, 10, 20, 9, 30, 0, 0, time.Local),
+		"2026-10-20":           time.Date(2026, 10, 20, 0, 0, 0, 0, time.Local),
+		"20/10/2026 09:30":     time.Date(2026, 10, 20, 9, 30, 0, 0, time.Local),
+		"20/10/2026":           time.Date(2026, 10, 20, 0, 0, 0, 0, time.Local),
+		"10-20-26":             time.Date(2026, 10, 20, 0, 0, 0, 0, time.Local),
+	}
+
+	for value, want := range cases {
+		got, err := parseImportDate(value)
+		if err != nil {
+			t.Errorf("parseImportDate(%q) failed: %v", value, err)
+			continue
+		}
+		if !got.Time().Equal(want) {
+			t.Errorf("parseImportDate(%q) = %s, want %s", value, got.Time(), want.UTC())
+		}
+	}
+
+	for _, value := range []string{"", "tomorrow", "32/01/2026", "2026/10/20"} {
+		if _, err := parseImportDate(value); err == nil {
+			t.Errorf("parseImportDate(%q) should fail", value)
+		}
+	}
+}
+
+func TestParseImportStatus(t *testing.T) {
+	cases := map[string]string{
+		"todo":           "todo",
+		" IN_PROGRESS ":  "in_progress",
+		"Đang thực hiện": "in_progress",
+		"hoàn thành":     "done",
+		"In Progress":    "in_progress",
+		"Canceled":       "canceled",
+		"tồn đọng":       "backlog",
+	}
+
+	for value, want := range cases {
+		got, ok := parseImportStatus(value)
+		if !ok || got != want {
+			t.Errorf("parseImportStatus(%q) = %q, %v, want %q", value, got, ok, want)
+		}
+	}
+
+	if status, ok := parseImportStatus("later"); ok {
+		t.Errorf("parseImportStatus(later) = %q, should fail", status)
+	}
+}
+
+func TestMapImportColumns(t *testing.T) {
+	columns, err := mapImportColumns([]string{"\ufeffTiêu đề", " Hạn ", "unknown", "Người thực hiện", "STATUS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"title": 0, "due_date": 1, "assignees": 3, "status": 4}
+	if len(columns) != len(want) {
+		t.Fatalf("mapImportColumns = %v, want %v", columns, want)
+	}
+	for field, index := range want {
+		if columns[field] != index {
+			t.Errorf("column of %s = %d, want %d", field, columns[field], index)
+		}
+	}
+
+	if _, err := mapImportColumns([]string{"description", "status"}); err == nil {
+		t.Fatal("expected the header without a title column to be rejected")
+	}
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -18,8 +23,11 @@ import (
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/plugins/migratecmd"
+	"github.com/pocketbase/pocketbase/tools/security"
 	"github.com/pocketbase/pocketbase/tools/types"
 
+	_ "be.monk.house/migrations"
 	"be.monk.house/notification"
 )
 
@@ -41,6 +49,7 @@ type MattermostUser struct {
 	AvatarURL   string `json:"avatar_url"`
 	Locale      string `json:"locale"`
 	Timezone    any    `json:"timezone"`
+	IsBot       bool   `json:"is_bot"`
 	DeleteAt    int64  `json:"delete_at"`
 	CreateAt    int64  `json:"create_at"`
 	UpdateAt    int64  `json:"update_at"`
@@ -74,49 +83,71 @@ func main() {
 
 	app := pocketbase.New()
 
+	migratecmd.MustRegister(app, app.RootCmd, migratecmd.Config{})
+
+	// Mattermost OAuth tokens of the users
+	tokens := newMattermostTokenStore(app)
+
+	outbox := notification.NewOutbox(
+		app,
+		notification.MattermostNotifier{UserToken: tokens.AccessToken},
+		notification.NewEmailNotifier(app),
+		notification.NewWebhookNotifier(),
+		notification.NewInAppNotifier(app),
+	)
+
 	app.OnRecordAfterCreateSuccess("tasks").BindFunc(func(e *core.RecordEvent) error {
-		channelIds := []string{}
-		departmentIds := e.Record.GetStringSlice("departments")
-		assigneeIds := e.Record.GetStringSlice("assignees")
-		// Get Mattermost channels from assignees
-		for _, userId := range assigneeIds {
-			user, err := app.FindRecordById("users", userId)
-			if err == nil && user != nil {
-				mmChannel := user.GetString("mm_channel")
-				if mmChannel != "" {
-					channelIds = append(channelIds, mmChannel)
-				}
-			}
+		if !taskNotificationsSkipped(e.Context) {
+			notifyTaskCreated(app, outbox, e.Record)
 		}
+		return e.Next()
+	})
 
-		// Get Mattermost channels from departments
-		for _, deptId := range departmentIds {
-			dept, err := app.FindRecordById("departments", deptId)
-			if err == nil && dept != nil {
-				mattermostChannel := dept.GetString("mattermost_channel")
-				if mattermostChannel != "" {
-					channelIds = append(channelIds, mattermostChannel)
-				}
-			}
+	app.OnRecordAfterUpdateSuccess("tasks").BindFunc(func(e *core.RecordEvent) error {
+		if !taskNotificationsSkipped(e.Context) {
+			notifyTaskUpdated(app, outbox, e.Record, taskChangeActor(e))
 		}
+		resetTaskReminders(app, e.Record)
+		return e.Next()
+	})
 
-		taskTitle := e.Record.Get("title")
-		taskDetailLink := fmt.Sprintf("%s/%s", os.Getenv("APP_URL"), e.Record.Id)
-		message := fmt.Sprintf("**%s %s**\n%s%s", "[Công việc mới]", taskTitle, "Vui lòng xác nhận và xem chi tiết công việc tại link sau: ", taskDetailLink)
+	app.OnRecordCreate("tasks").BindFunc(func(e *core.RecordEvent) error {
+		stampCompletedAt(e.Record)
+		return e.Next()
+	})
 
-		_, err := notification.PostMessageToMattermost(channelIds, message)
-		if err != nil {
-			log.Println(err)
-		}
+	app.OnRecordUpdate("tasks").BindFunc(func(e *core.RecordEvent) error {
+		stampCompletedAt(e.Record)
+		return e.Next()
+	})
+
+	// Thread new feedbacks under the Mattermost announcement of their task, as their sender when possible
+	app.OnRecordAfterCreateSuccess("feedbacks").BindFunc(func(e *core.RecordEvent) error {
+		postFeedbackReply(app, outbox, e.Record)
 		return e.Next()
 	})
 
+	app.OnRecordCreateRequest("departments").BindFunc(validateDigestSchedule)
+	app.OnRecordUpdateRequest("departments").BindFunc(validateDigestSchedule)
+	app.OnRecordCreateRequest("departments").BindFunc(validateDepartmentChannel)
+	app.OnRecordUpdateRequest("departments").BindFunc(validateDepartmentChannel)
+
+	app.OnRecordCreateRequest(membershipsCollection).BindFunc(validateMembership)
+	app.OnRecordUpdateRequest(membershipsCollection).BindFunc(validateMembership)
+
+	app.OnRecordCreateRequest(notification.TemplatesCollection).BindFunc(notification.ValidateTemplate)
+	app.OnRecordUpdateRequest(notification.TemplatesCollection).BindFunc(notification.ValidateTemplate)
+
 	// fires only for "tasks" collections
 	app.OnRecordCreateRequest("tasks").BindFunc(func(e *core.RecordRequestEvent) error {
 		if !e.Auth.IsSuperuser() {
 			e.Record.Set("createdBy", e.Auth.Id)
 		}
 
+		if assignMembersRequested(e) {
+			assignDepartmentMembers(app, e.Record)
+		}
+
 		return e.Next()
 	})
 
@@ -126,6 +157,10 @@ func main() {
 			e.Record.Set("updatedBy", e.Auth.Id)
 		}
 
+		if assignMembersRequested(e) {
+			assignDepartmentMembers(app, e.Record)
+		}
+
 		return e.Next()
 	})
 
@@ -133,10 +168,86 @@ func main() {
 		return e.Next()
 	})
 
+	// Users created from Mattermost sign in through the Mattermost login only
+	app.OnRecordAuthWithPasswordRequest("users").BindFunc(rejectMattermostPasswordAuth)
+	app.OnRecordCreateRequest("users").BindFunc(protectIdentityFields)
+	app.OnRecordUpdateRequest("users").BindFunc(protectIdentityFields)
+
+	// Deactivated users are signed out and can't sign in again
+	app.OnRecordAuthRequest("users").BindFunc(rejectBlockedUserAuth)
+	app.OnRecordUpdate("users").BindFunc(revokeBlockedUserTokens)
+
+	// Roles grant the permissions, only superusers change them
+	app.OnRecordCreateRequest("users").BindFunc(superuserOnlyFields("roles"))
+	app.OnRecordUpdateRequest("users").BindFunc(superuserOnlyFields("roles"))
+
+	// The server posts to the webhook of the user, only superusers set it up
+	app.OnRecordCreateRequest("users").BindFunc(superuserOnlyFields("webhook_url", "notify_via"))
+	app.OnRecordUpdateRequest("users").BindFunc(superuserOnlyFields("webhook_url", "notify_via"))
+
+	// Audit log of the task, user, department, group, feedback and membership changes
+	bindAuditHooks(app)
+
+	// Role permissions, checked after the hooks above filled in the task
+	app.OnRecordCreateRequest("tasks").BindFunc(requireRecordPermission(permissionTaskCreate))
+	app.OnRecordCreateRequest("tasks").BindFunc(validateTaskAssignees)
+	app.OnRecordUpdateRequest("tasks").BindFunc(validateTaskAssignees)
+
+	for _, collection := range []string{"departments", "groups"} {
+		app.OnRecordCreateRequest(collection).BindFunc(requireRecordPermission(permissionDepartmentManage))
+		app.OnRecordUpdateRequest(collection).BindFunc(requireRecordPermission(permissionDepartmentManage))
+		app.OnRecordDeleteRequest(collection).BindFunc(requireRecordPermission(permissionDepartmentManage))
+	}
+
+	// Due-date reminders and overdue escalation
+	reminderOffsets := getReminderOffsets()
+	app.Cron().MustAdd("taskReminders", getReminderCron(), func() {
+		runTaskReminders(app, outbox, reminderOffsets)
+	})
+
+	// Daily/weekly task digests. Checked every minute: the departments have their own
+	// cron schedules and the user digest is due in each user's timezone, some of which
+	// are offset by 30 or 45 minutes. A run only reads the distinct user timezones and
+	// the scheduled departments, the users are loaded when their digest is due.
+	userDigestSchedule := getUserDigestSchedule()
+	app.Cron().MustAdd("taskDigests", "* * * * *", func() {
+		runDigests(app, outbox, userDigestSchedule)
+	})
+
+	// Mattermost user directory sync, then the department members from their channels
+	app.Cron().MustAdd("mattermostDirectorySync", getDirectorySyncCron(), func() {
+		if _, err := runDirectorySync(app, outbox, getDirectorySyncProvision()); err != nil {
+			log.Printf("Directory sync: %v", err)
+			return
+		}
+		if _, err := runDepartmentSync(app); err != nil {
+			log.Printf("Department sync: %v", err)
+		}
+	})
+
+	// Refresh the Mattermost tokens of the users before they expire
+	app.Cron().MustAdd("mattermostTokenRefresh", "*/5 * * * *", func() {
+		tokens.RefreshExpiring()
+	})
+
+	app.OnTerminate().BindFunc(func(e *core.TerminateEvent) error {
+		outbox.Stop()
+		return e.Next()
+	})
+
+	// Posts per user per minute through /api/mattermost/post
+	postLimiter := newRateLimiter(getMattermostPostRateLimit(), time.Minute)
+
+	// OAuth callbacks and code exchanges per IP per minute
+	callbackLimiter := newRateLimiter(getOAuthRateLimit(), time.Minute)
+	exchangeLimiter := newRateLimiter(getOAuthRateLimit(), time.Minute)
+
 	// Mattermost OAuth2 Routes
 	app.OnServe().BindFunc(func(e *core.ServeEvent) error {
 		log.Println("PocketBase server starting with Mattermost OAuth2 integration...")
 
+		outbox.Start()
+
 		// OAuth2 Login Route - Redirect to Mattermost
 		e.Router.GET("/api/auth/mattermost/login", func(c *core.RequestEvent) error {
 			return handleMattermostLogin(c, app)
@@ -144,22 +255,149 @@ func main() {
 
 		// OAuth2 Callback Route - Handle Mattermost response
 		e.Router.GET("/api/auth/mattermost/callback", func(c *core.RequestEvent) error {
-			return handleMattermostCallback(c, app)
-		})
+			return handleMattermostCallback(c, app, tokens)
+		}).Bind(rateLimit(callbackLimiter, ipRateLimitKey))
 
+		// Exchange the one-time code of the callback for an auth token
 		e.Router.POST("/api/auth/exchange", func(c *core.RequestEvent) error {
 			return handleOAuthExchange(c, app)
-		})
+		}).Bind(rateLimit(exchangeLimiter, ipRateLimitKey))
 
 		e.Router.GET("/api/mattermost/avatar/{id}", func(c *core.RequestEvent) error {
 			return handleMattermostAvartar(c)
 		})
 
-		// Mattermost API route - Post message to Mattermost channel
+		// Mattermost API route - Post message to the Mattermost channels linked to the user
 		e.Router.POST("/api/mattermost/post", func(c *core.RequestEvent) error {
-			return notification.HandleMattermostPost(c)
+			return notification.HandleMattermostPost(c, func(channelID string) bool {
+				return canPostToChannel(app, c.Auth, channelID)
+			})
+		}).Bind(requirePermission(permissionMattermostPost), rateLimit(postLimiter, authRateLimitKey))
+
+		// Mattermost "/task" slash command
+		e.Router.POST("/api/mattermost/command", func(c *core.RequestEvent) error {
+			return handleSlashCommand(c, app)
+		})
+
+		// Mattermost interactive message actions (task buttons)
+		e.Router.POST("/api/mattermost/actions", func(c *core.RequestEvent) error {
+			return handleMattermostAction(c, app)
+		})
+
+		// Mattermost outgoing webhook - thread replies become task feedbacks
+		e.Router.POST("/api/mattermost/thread-reply", func(c *core.RequestEvent) error {
+			return handleMattermostThreadReply(c, app)
+		})
+
+		// Run the Mattermost user directory sync now
+		e.Router.POST("/api/mattermost/sync", func(c *core.RequestEvent) error {
+			return handleDirectorySync(c, app, outbox)
+		}).Bind(apis.RequireSuperuserAuth())
+
+		// Mattermost teams and channels of the bot, to link departments
+		e.Router.GET("/api/mattermost/teams", func(c *core.RequestEvent) error {
+			return handleMattermostTeams(c)
+		}).Bind(requirePermission(permissionDepartmentManage))
+
+		e.Router.GET("/api/mattermost/teams/{id}/channels", func(c *core.RequestEvent) error {
+			return handleMattermostChannels(c, app)
+		}).Bind(requirePermission(permissionDepartmentManage))
+
+		// Create and link a Mattermost channel for a department
+		e.Router.POST("/api/departments/{id}/channel", func(c *core.RequestEvent) error {
+			return handleCreateDepartmentChannel(c, app)
+		}).Bind(requirePermission(permissionDepartmentManage))
+
+		// Sync the department members with their Mattermost channel now
+		e.Router.POST("/api/mattermost/departments/sync", func(c *core.RequestEvent) error {
+			return handleDepartmentSync(c, app)
+		}).Bind(apis.RequireSuperuserAuth())
+
+		// Department and group members with their role, managed by superusers and the managers
+		e.Router.GET("/api/departments/{id}/members", func(c *core.RequestEvent) error {
+			return handleListMembers(c, app, "departments")
+		}).Bind(apis.RequireAuth())
+
+		e.Router.PUT("/api/departments/{id}/members/{user}", func(c *core.RequestEvent) error {
+			return handleSetMember(c, app, "departments")
+		}).Bind(apis.RequireAuth())
+
+		e.Router.DELETE("/api/departments/{id}/members/{user}", func(c *core.RequestEvent) error {
+			return handleRemoveMember(c, app, "departments")
+		}).Bind(apis.RequireAuth())
+
+		e.Router.GET("/api/groups/{id}/members", func(c *core.RequestEvent) error {
+			return handleListMembers(c, app, "groups")
+		}).Bind(apis.RequireAuth())
+
+		e.Router.PUT("/api/groups/{id}/members/{user}", func(c *core.RequestEvent) error {
+			return handleSetMember(c, app, "groups")
+		}).Bind(apis.RequireAuth())
+
+		e.Router.DELETE("/api/groups/{id}/members/{user}", func(c *core.RequestEvent) error {
+			return handleRemoveMember(c, app, "groups")
+		}).Bind(apis.RequireAuth())
+
+		// Audit log query
+		e.Router.GET("/api/audit", func(c *core.RequestEvent) error {
+			return handleAuditLog(c, app)
+		}).Bind(apis.RequireAuth())
+
+		// Notification preferences of the current user
+		e.Router.GET("/api/notifications/preferences", func(c *core.RequestEvent) error {
+			return notification.HandleGetPreferences(c)
+		}).Bind(apis.RequireAuth("users"))
+
+		e.Router.PUT("/api/notifications/preferences", func(c *core.RequestEvent) error {
+			return notification.HandleUpdatePreferences(c)
+		}).Bind(apis.RequireAuth("users"))
+
+		// Bulk task creation, one notification per channel
+		e.Router.POST("/api/tasks/bulk", func(c *core.RequestEvent) error {
+			return handleBulkCreateTasks(c, app, outbox)
+		}).Bind(requirePermission(permissionTaskCreate))
+
+		// Task import from a CSV/XLSX file, with a dry-run validation report
+		e.Router.POST("/api/tasks/import", func(c *core.RequestEvent) error {
+			return handleImportTasks(c, app, outbox)
+		}).Bind(requirePermission(permissionTaskCreate))
+
+		// Task export (csv, xlsx, ics) with the records list filter syntax
+		e.Router.GET("/api/tasks/export", func(c *core.RequestEvent) error {
+			return handleExportTasks(c, app)
+		}).Bind(requirePermission(permissionTaskExport))
+
+		// Per-user calendar feed of the task deadlines
+		e.Router.GET("/api/calendar/feed", func(c *core.RequestEvent) error {
+			return handleCalendarFeedURL(c, app, false)
+		}).Bind(apis.RequireAuth("users"))
+
+		e.Router.POST("/api/calendar/feed/rotate", func(c *core.RequestEvent) error {
+			return handleCalendarFeedURL(c, app, true)
+		}).Bind(apis.RequireAuth("users"))
+
+		e.Router.GET("/api/calendar/{token}", func(c *core.RequestEvent) error {
+			return handleCalendarFeed(c, app)
 		})
-		// .Bind(apis.RequireAuth())
+
+		// Notification delivery report of a task
+		e.Router.GET("/api/tasks/{id}/notifications", func(c *core.RequestEvent) error {
+			return handleTaskNotificationReport(c, app)
+		}).Bind(apis.RequireAuth())
+
+		// Notification outbox - list and re-drive failed deliveries
+		e.Router.GET("/api/notifications/outbox", func(c *core.RequestEvent) error {
+			return outbox.HandleOutboxList(c)
+		}).Bind(apis.RequireSuperuserAuth())
+
+		e.Router.POST("/api/notifications/outbox/retry", func(c *core.RequestEvent) error {
+			return outbox.HandleOutboxRetry(c)
+		}).Bind(apis.RequireSuperuserAuth())
+
+		// Notification templates - render a template against a task or a sample task
+		e.Router.POST("/api/notifications/templates/preview", func(c *core.RequestEvent) error {
+			return notification.HandleTemplatePreview(c)
+		}).Bind(apis.RequireSuperuserAuth())
 
 		// Health check
 		e.Router.GET("/health", func(c *core.RequestEvent) error {
@@ -225,28 +463,36 @@ func handleMattermostAvartar(c *core.RequestEvent) error {
 func handleMattermostLogin(c *core.RequestEvent, app *pocketbase.PocketBase) error {
 	config := getMattermostConfig()
 
+	// SHA-256 of a secret kept by the app, the exchange code is only given
+	// back for that secret (see handleOAuthExchange)
+	challenge := c.Request.URL.Query().Get("challenge")
+	if !pkceChallengePattern.MatchString(challenge) {
+		return c.JSON(400, AuthResponse{
+			Success: false,
+			Error:   "Invalid challenge parameter",
+		})
+	}
+
 	// Generate state for CSRF protection
 	state := generateState()
 
-	// Store state in session/cookie (simplified for demo)
-	// In production, use proper session management
-	c.SetCookie(&http.Cookie{
-		Name:     "oauth_state",
-		Value:    state,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	// PKCE verifier of the Mattermost authorization code
+	verifier := generateState()
+
+	c.SetCookie(oauthCookie("oauth_state", state))
+	c.SetCookie(oauthCookie("oauth_verifier", verifier))
+	c.SetCookie(oauthCookie("oauth_challenge", challenge))
 
 	// Build Mattermost OAuth2 URL
 	authURL := fmt.Sprintf("%s/oauth/authorize", config.ServerURL)
 	params := url.Values{
-		"client_id":     {config.ClientID},
-		"redirect_uri":  {config.RedirectURI},
-		"response_type": {"code"},
-		"scope":         {"read"},
-		"state":         {state},
+		"client_id":             {config.ClientID},
+		"redirect_uri":          {config.RedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"read"},
+		"state":                 {state},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
 	}
 
 	redirectURL := fmt.Sprintf("%s?%s", authURL, params.Encode())
@@ -255,7 +501,7 @@ func handleMattermostLogin(c *core.RequestEvent, app *pocketbase.PocketBase) err
 }
 
 // Handle Mattermost OAuth2 Callback
-func handleMattermostCallback(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+func handleMattermostCallback(c *core.RequestEvent, app *pocketbase.PocketBase, tokens *mattermostTokenStore) error {
 	// Get query parameters correctly
 	queryParams := c.Request.URL.Query()
 	code := queryParams.Get("code")
@@ -263,15 +509,31 @@ func handleMattermostCallback(c *core.RequestEvent, app *pocketbase.PocketBase)
 
 	// Verify state (CSRF protection)
 	cookie, err := c.Request.Cookie("oauth_state")
-	if err != nil || cookie.Value != state {
+	if err != nil || state == "" || cookie.Value != state {
 		return c.JSON(400, AuthResponse{
 			Success: false,
 			Error:   "Invalid state parameter",
 		})
 	}
 
+	verifier, err := c.Request.Cookie("oauth_verifier")
+	if err != nil || verifier.Value == "" {
+		return c.JSON(400, AuthResponse{
+			Success: false,
+			Error:   "Missing PKCE verifier",
+		})
+	}
+
+	challenge, err := c.Request.Cookie("oauth_challenge")
+	if err != nil || !pkceChallengePattern.MatchString(challenge.Value) {
+		return c.JSON(400, AuthResponse{
+			Success: false,
+			Error:   "Invalid challenge parameter",
+		})
+	}
+
 	// Exchange code for token
-	token, err := exchangeCodeForToken(code)
+	token, err := exchangeCodeForToken(code, verifier.Value)
 	if err != nil {
 		log.Printf("Token exchange failed: %v", err)
 		return c.JSON(400, AuthResponse{
@@ -292,6 +554,12 @@ func handleMattermostCallback(c *core.RequestEvent, app *pocketbase.PocketBase)
 
 	// Map Mattermost user to PocketBase user
 	user, err := mapMattermostUserToPocketBase(app, mmUser)
+	if errors.Is(err, errIdentityConflict) {
+		return c.JSON(409, AuthResponse{
+			Success: false,
+			Error:   "The Mattermost account conflicts with another user, contact an administrator",
+		})
+	}
 	if err != nil {
 		log.Printf("Failed to map user to PocketBase: %v", err)
 		return c.JSON(500, AuthResponse{
@@ -300,16 +568,17 @@ func handleMattermostCallback(c *core.RequestEvent, app *pocketbase.PocketBase)
 		})
 	}
 
-	// Clear OAuth state cookie
-	c.SetCookie(&http.Cookie{
-		Name:     "oauth_state",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	// Keep the tokens to act in Mattermost as the user
+	if err := tokens.Save(user["id"].(string), token); err != nil {
+		log.Printf("Failed to save the Mattermost token of user %s: %v", user["id"], err)
+	}
+
+	// Clear the OAuth cookies
+	for _, name := range []string{"oauth_state", "oauth_verifier", "oauth_challenge"} {
+		cleared := oauthCookie(name, "")
+		cleared.MaxAge = -1
+		c.SetCookie(cleared)
+	}
 
 	collection, err := app.FindCollectionByNameOrId("oauth_sessions")
 	if err != nil {
@@ -335,7 +604,7 @@ func handleMattermostCallback(c *core.RequestEvent, app *pocketbase.PocketBase)
 		return c.Redirect(302, redirectURL)
 	}
 
-	exchangeCode, err := createOAuthSession(app, user["id"].(string), state)
+	exchangeCode, err := createOAuthSession(app, user["id"].(string), state, challenge.Value)
 	if err != nil {
 		return c.JSON(500, map[string]string{
 			"error": "failed to create oauth session",
@@ -351,19 +620,23 @@ func handleMattermostCallback(c *core.RequestEvent, app *pocketbase.PocketBase)
 	return c.Redirect(http.StatusFound, redirectURL)
 }
 
-// Exchange authorization code for access token
-func exchangeCodeForToken(code string) (*OAuthTokenResponse, error) {
+// Exchange authorization code for access token, with the PKCE verifier of the login
+func exchangeCodeForToken(code string, verifier string) (*OAuthTokenResponse, error) {
 	config := getMattermostConfig()
 
-	tokenURL := fmt.Sprintf("%s/oauth/access_token", config.ServerURL)
-
-	data := url.Values{
+	return requestOAuthToken(url.Values{
 		"grant_type":    {"authorization_code"},
 		"client_id":     {config.ClientID},
 		"client_secret": {config.ClientSecret},
 		"code":          {code},
 		"redirect_uri":  {config.RedirectURI},
-	}
+		"code_verifier": {verifier},
+	})
+}
+
+// Call the Mattermost OAuth token endpoint, for a code or a refresh token
+func requestOAuthToken(data url.Values) (*OAuthTokenResponse, error) {
+	tokenURL := fmt.Sprintf("%s/oauth/access_token", getMattermostConfig().ServerURL)
 
 	resp, err := http.PostForm(tokenURL, data)
 	if err != nil {
@@ -376,6 +649,10 @@ func exchangeCodeForToken(code string) (*OAuthTokenResponse, error) {
 		return nil, err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, &mattermostAPIError{StatusCode: resp.StatusCode, Message: string(body)}
+	}
+
 	var token OAuthTokenResponse
 	if err := json.Unmarshal(body, &token); err != nil {
 		return nil, err
@@ -431,15 +708,11 @@ func mapMattermostUserToPocketBase(app *pocketbase.PocketBase, mmUser *Mattermos
 		return nil, fmt.Errorf("failed to find users collection: %v", err)
 	}
 
-	// Create a query to find existing user
-	// existingRecords := []*models.Record{}
-	// existingRecords := core.NewRecord(collection)
-	existingRecord, err := app.FindFirstRecordByFilter(collection, "email = {:email}", dbx.Params{"email": mmUser.Email})
-	// if err := app.DB().NewQuery(collection).
-	// 	AndWhere(dbx.HashExp{"email": mmUser.Email}).
-	// 	All(&existingRecords); err != nil {
-	// 	return nil, fmt.Errorf("failed to query existing users: %v", err)
-	// }
+	// Find the user linked to the Mattermost account, or with its email
+	existingRecord, err := findMattermostUser(app, mmUser)
+	if err != nil {
+		return nil, err
+	}
 
 	userRecord := core.NewRecord(collection)
 
@@ -448,9 +721,12 @@ func mapMattermostUserToPocketBase(app *pocketbase.PocketBase, mmUser *Mattermos
 	if existingRecord != nil {
 		// Update existing user
 		userRecord = existingRecord
+		linkMattermostUser(app, userRecord, mmUser)
 		userRecord.Set("name", fmt.Sprintf("%s %s", mmUser.FirstName, mmUser.LastName))
 		userRecord.Set("username", mmUser.Username)
 		userRecord.Set("avatar_url", fmt.Sprintf("%s/api/mattermost/avatar/%s", pocketbaseServerUrl, mmUser.ID))
+		userRecord.Set("timezone", mattermostTimezone(mmUser.Timezone))
+		userRecord.Set("locale", mmUser.Locale)
 		userRecord.Set("updated", types.NowDateTime())
 
 		if err := app.Save(userRecord); err != nil {
@@ -465,17 +741,22 @@ func mapMattermostUserToPocketBase(app *pocketbase.PocketBase, mmUser *Mattermos
 			return nil, err
 		}
 
-		userRecord.Set("id", mmUser.ID)
+		// the record id is generated, the Mattermost account is linked by mm_user_id
+		userRecord.Set("mm_user_id", mmUser.ID)
 		userRecord.Set("email", mmUser.Email)
 		userRecord.Set("name", fmt.Sprintf("%s %s", mmUser.FirstName, mmUser.LastName))
 		userRecord.Set("username", mmUser.Username)
 		userRecord.Set("avatar_url", fmt.Sprintf("%s/api/mattermost/avatar/%s", pocketbaseServerUrl, mmUser.ID))
+		userRecord.Set("timezone", mattermostTimezone(mmUser.Timezone))
+		userRecord.Set("locale", mmUser.Locale)
 		userRecord.Set("status", "active")
 		userRecord.Set("roles", roleIds)
 		userRecord.Set("phoneNumber", "")
 		userRecord.Set("created", types.NowDateTime())
 		userRecord.Set("updated", types.NowDateTime())
-		userRecord.Set("password", "tonkinhPhat1A@")
+		// unguessable, Mattermost users can't sign in with a password
+		userRecord.Set("password", security.RandomString(40))
+		userRecord.Set("auth_source", authSourceMattermost)
 		userRecord.Set("verified", true)
 
 		if err := app.Save(userRecord); err != nil {
@@ -496,7 +777,6 @@ func mapMattermostUserToPocketBase(app *pocketbase.PocketBase, mmUser *Mattermos
 			}
 		}
 	}
-	fmt.Printf("New avatar url is %s", userRecord.Get("avatar_url"))
 
 	// Return user data
 	user := map[string]any{
@@ -506,6 +786,35 @@ func mapMattermostUserToPocketBase(app *pocketbase.PocketBase, mmUser *Mattermos
 	return user, nil
 }
 
+// Auth source of the users created from a Mattermost login or sync
+const authSourceMattermost = "mattermost"
+
+// Password auth of the Mattermost users fails like a wrong password
+func rejectMattermostPasswordAuth(e *core.RecordAuthWithPasswordRequestEvent) error {
+	if e.Record != nil && e.Record.GetString("auth_source") == authSourceMattermost {
+		return apis.NewBadRequestError("Failed to authenticate.", nil)
+	}
+	return e.Next()
+}
+
+// Get the IANA timezone name from the Mattermost user timezone settings, eg.
+// {"useAutomaticTimezone": "true", "automaticTimezone": "Asia/Ho_Chi_Minh", "manualTimezone": ""}
+func mattermostTimezone(timezone any) string {
+	settings, ok := timezone.(map[string]any)
+	if !ok {
+		return ""
+	}
+
+	automatic, _ := settings["automaticTimezone"].(string)
+	manual, _ := settings["manualTimezone"].(string)
+
+	if useAutomatic, _ := settings["useAutomaticTimezone"].(string); useAutomatic == "true" || manual == "" {
+		return automatic
+	}
+
+	return manual
+}
+
 // Get Mattermost configuration from environment
 func getMattermostConfig() MattermostConfig {
 	return MattermostConfig{
@@ -523,6 +832,36 @@ func generateState() string {
 	return base64.RawURLEncoding.EncodeToString(b)
 }
 
+// Base64url SHA-256 of a PKCE verifier (the S256 method)
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+var pkceChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// Cookie of the OAuth login, kept until the callback
+func oauthCookie(name string, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Default OAuth callback and exchange requests per IP per minute, overridable with OAUTH_RATE_LIMIT
+const defaultOAuthRateLimit = 20
+
+func getOAuthRateLimit() int {
+	if limit, err := strconv.Atoi(os.Getenv("OAUTH_RATE_LIMIT")); err == nil && limit > 0 {
+		return limit
+	}
+	return defaultOAuthRateLimit
+}
+
 // Create Mattermost direct channel between bot and user
 func createMattermostDirectChannel(botId string, userId string) (string, error) {
 	mmToken := os.Getenv("MATTERMOST_BOT_TOKEN")
@@ -575,6 +914,7 @@ func createOAuthSession(
 	app *pocketbase.PocketBase,
 	userId string,
 	state string,
+	challenge string,
 ) (string, error) {
 
 	collection, err := app.FindCollectionByNameOrId("oauth_sessions")
@@ -589,6 +929,7 @@ func createOAuthSession(
 	record.Set("user", userId)
 	record.Set("used", false)
 	record.Set("state", state)
+	record.Set("challenge", challenge)
 	record.Set("expiresAt", time.Now().Add(2*time.Minute))
 
 	if err := app.Save(record); err != nil {
@@ -598,38 +939,86 @@ func createOAuthSession(
 	return code, nil
 }
 
-func handleOAuthExchange(c *core.RequestEvent, app *pocketbase.PocketBase) error {
-	var body struct {
-		Code string `json:"code"`
-	}
+var (
+	errInvalidOAuthCode = errors.New("invalid code")
+	errExpiredOAuthCode = errors.New("code expired")
+)
 
-	if err := c.BindBody(&body); err != nil {
-		return c.JSON(400, map[string]string{"error": "invalid request"})
+// Use the one-time code of a login and return its user. The verifier must match
+// the challenge sent by the browser that started the login.
+func useOAuthCode(app core.App, code string, verifier string) (string, error) {
+	collection, err := app.FindCollectionByNameOrId("oauth_sessions")
+	if err != nil {
+		return "", err
 	}
 
-	collection, _ := app.FindCollectionByNameOrId("oauth_sessions")
-
 	session, err := app.FindFirstRecordByFilter(
 		collection,
 		"code = {:code} && used = false",
-		dbx.Params{"code": body.Code},
+		dbx.Params{"code": code},
 	)
 	if err != nil {
-		return c.JSON(400, map[string]string{"error": "invalid code"})
+		return "", errInvalidOAuthCode
 	}
 
 	expires := session.GetDateTime("expiresAt")
 	if expires.Time().Before(time.Now()) {
+		return "", errExpiredOAuthCode
+	}
+
+	// only the browser that started the login can use the code
+	challenge := session.GetString("challenge")
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(pkceChallenge(verifier)), []byte(challenge)) != 1 {
+		return "", errInvalidOAuthCode
+	}
+
+	// mark the code used in one statement, only one of parallel exchanges succeeds
+	result, err := app.DB().Update(
+		collection.Name,
+		dbx.Params{"used": true},
+		dbx.HashExp{"id": session.Id, "used": false},
+	).Execute()
+	if err != nil {
+		return "", err
+	}
+	if consumed, _ := result.RowsAffected(); consumed != 1 {
+		return "", errInvalidOAuthCode
+	}
+
+	return session.GetString("user"), nil
+}
+
+func handleOAuthExchange(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	var body struct {
+		Code string `json:"code"`
+		// secret whose SHA-256 was the challenge of the login
+		Verifier string `json:"verifier"`
+	}
+
+	if err := c.BindBody(&body); err != nil {
+		return c.JSON(400, map[string]string{"error": "invalid request"})
+	}
+
+	userId, err := useOAuthCode(app, body.Code, body.Verifier)
+	switch {
+	case errors.Is(err, errExpiredOAuthCode):
 		return c.JSON(400, map[string]string{"error": "code expired"})
+	case errors.Is(err, errInvalidOAuthCode):
+		return c.JSON(400, map[string]string{"error": "invalid code"})
+	case err != nil:
+		return c.JSON(500, map[string]string{"error": "failed to use code"})
 	}
 
-	userId := session.GetString("user")
 	user, err := app.FindRecordById("users", userId)
 
 	if err != nil {
 		return c.JSON(400, map[string]string{"error": "user not found"})
 	}
 
+	if isUserBlocked(user) {
+		return c.JSON(403, map[string]string{"error": "account deactivated"})
+	}
+
 	errs := app.ExpandRecord(user, []string{"roles"}, nil)
 	if len(errs) > 0 {
 		return fmt.Errorf("failed to expand: %v", errs)
@@ -650,16 +1039,14 @@ func handleOAuthExchange(c *core.RequestEvent, app *pocketbase.PocketBase) error
 		return c.JSON(500, map[string]string{"error": "token error"})
 	}
 
-	session.Set("used", true)
-	_ = app.Save(session)
-
 	userInfo := map[string]any{
-		"id":         user.Id,
-		"email":      user.GetString("email"),
-		"name":       user.GetString("name"),
-		"username":   user.GetString("username"),
-		"avatar_url": user.GetString("avatar_url"),
-		"roles":      roles,
+		"id":          user.Id,
+		"email":       user.GetString("email"),
+		"name":        user.GetString("name"),
+		"username":    user.GetString("username"),
+		"avatar_url":  user.GetString("avatar_url"),
+		"roles":       roles,
+		"permissions": userPermissions(app, user),
 	}
 
 	// Return success response
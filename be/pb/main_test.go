@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// Test app on an empty data dir with the app migrations applied
+func newTestApp(t *testing.T) *tests.TestApp {
+	t.Helper()
+
+	app, err := tests.NewTestApp(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.Cleanup)
+
+	return app
+}
+
+func newTestUser(t *testing.T, app core.App, email string) *core.Record {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := core.NewRecord(collection)
+	user.SetEmail(email)
+	user.SetPassword("password123")
+	if err := app.Save(user); err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	// base64url of SHA-256("abc")
+	if got, want := pkceChallenge("abc"), "ungWv48Bz-pBQUDeXa4iI7ADYaOWF3qctBD_YfIAFa0"; got != want {
+		t.Fatalf("pkceChallenge(abc) = %s, want %s", got, want)
+	}
+
+	if !pkceChallengePattern.MatchString(pkceChallenge("any verifier")) {
+		t.Fatal("the challenge doesn't match the accepted challenge pattern")
+	}
+}
+
+func TestUseOAuthCode(t *testing.T) {
+	app := newTestApp(t)
+	user := newTestUser(t, app, "an@example.org")
+
+	collection, err := app.FindCollectionByNameOrId("oauth_sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newSession := func(code string, ttl time.Duration) {
+		t.Helper()
+		session := core.NewRecord(collection)
+		session.Set("code", code)
+		session.Set("user", user.Id)
+		session.Set("challenge", pkceChallenge("verifier-"+code))
+		session.Set("expiresAt", time.Now().Add(ttl))
+		if err := app.Save(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newSession("valid", time.Minute)
+	newSession("expired", -time.Minute)
+
+	if _, err := useOAuthCode(app, "valid", "wrong verifier"); !errors.Is(err, errInvalidOAuthCode) {
+		t.Fatalf("expected the wrong verifier to be rejected, got %v", err)
+	}
+
+	userId, err := useOAuthCode(app, "valid", "verifier-valid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userId != user.Id {
+		t.Fatalf("expected user %s, got %s", user.Id, userId)
+	}
+
+	if _, err := useOAuthCode(app, "valid", "verifier-valid"); !errors.Is(err, errInvalidOAuthCode) {
+		t.Fatalf("expected the used code to be rejected, got %v", err)
+	}
+
+	if _, err := useOAuthCode(app, "expired", "verifier-expired"); !errors.Is(err, errExpiredOAuthCode) {
+		t.Fatalf("expected the expired code to be rejected, got %v", err)
+	}
+
+	if _, err := useOAuthCode(app, "unknown", "verifier-unknown"); !errors.Is(err, errInvalidOAuthCode) {
+		t.Fatalf("expected the unknown code to be rejected, got %v", err)
+	}
+}
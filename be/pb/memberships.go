@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const membershipsCollection = "memberships"
+
+// Membership roles, a manager can see and reassign every task of the department
+const (
+	roleMember  = "member"
+	roleLead    = "lead"
+	roleManager = "manager"
+)
+
+var membershipRoles = []string{roleMember, roleLead, roleManager}
+
+// Membership field of a department or group collection
+func membershipField(collection string) string {
+	if collection == "groups" {
+		return "group"
+	}
+	return "department"
+}
+
+// Ids of the users with one of the roles (any role when none is given) in the departments
+func departmentMemberIds(app core.App, departmentIds []string, roles ...string) []string {
+	if len(departmentIds) == 0 {
+		return []string{}
+	}
+
+	exprs := []dbx.Expression{dbx.In("department", toAny(departmentIds)...)}
+	if len(roles) > 0 {
+		exprs = append(exprs, dbx.In("role", toAny(roles)...))
+	}
+
+	memberships, err := app.FindAllRecords(membershipsCollection, exprs...)
+	if err != nil {
+		return []string{}
+	}
+
+	ids := []string{}
+	for _, membership := range memberships {
+		if userId := membership.GetString("user"); !slices.Contains(ids, userId) {
+			ids = append(ids, userId)
+		}
+	}
+	return ids
+}
+
+// Whether the user manages one of the departments
+func isDepartmentManager(app core.App, userId string, departmentIds []string) bool {
+	return slices.Contains(departmentMemberIds(app, departmentIds, roleManager), userId)
+}
+
+func toAny(values []string) []any {
+	result := make([]any, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
+
+// Add the members of the task departments to its assignees
+func assignDepartmentMembers(app core.App, task *core.Record) {
+	assignees := task.GetStringSlice("assignees")
+	for _, userId := range departmentMemberIds(app, task.GetStringSlice("departments")) {
+		if !slices.Contains(assignees, userId) {
+			assignees = append(assignees, userId)
+		}
+	}
+	task.Set("assignees", assignees)
+}
+
+// "assign_members": true in a task create/update request assigns the task to
+// the members of its departments
+func assignMembersRequested(e *core.RecordRequestEvent) bool {
+	info, err := e.RequestInfo()
+	if err != nil {
+		return false
+	}
+	assign, _ := info.Body["assign_members"].(bool)
+	return assign
+}
+
+// A membership is either in a department or in a group
+func validateMembership(e *core.RecordRequestEvent) error {
+	hasDepartment := e.Record.GetString("department") != ""
+	hasGroup := e.Record.GetString("group") != ""
+	if hasDepartment == hasGroup {
+		return apis.NewBadRequestError("A membership needs either a department or a group", nil)
+	}
+
+	return e.Next()
+}
+
+// Only the users with the department.manage permission and the managers of
+// the department/group can change its members
+func canManageMembers(c *core.RequestEvent, app core.App, collection string, recordId string) bool {
+	if hasPermission(app, c.Auth, permissionDepartmentManage) {
+		return true
+	}
+
+	_, err := app.FindFirstRecordByFilter(
+		membershipsCollection,
+		membershipField(collection)+" = {:id} && user = {:user} && role = {:role}",
+		dbx.Params{"id": recordId, "user": c.Auth.Id, "role": roleManager},
+	)
+	return err == nil
+}
+
+// List the members of a department or group with their role
+func handleListMembers(c *core.RequestEvent, app *pocketbase.PocketBase, collection string) error {
+	record, err := app.FindRecordById(collection, c.Request.PathValue("id"))
+	if err != nil {
+		return c.JSON(404, map[string]string{"error": "not found"})
+	}
+
+	memberships, err := app.FindAllRecords(membershipsCollection, dbx.HashExp{membershipField(collection): record.Id})
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to load members"})
+	}
+
+	if errs := app.ExpandRecords(memberships, []string{"user"}, nil); len(errs) > 0 {
+		return c.JSON(500, map[string]string{"error": "failed to load members"})
+	}
+
+	members := []map[string]any{}
+	for _, membership := range memberships {
+		member := map[string]any{
+			"id":   membership.Id,
+			"user": membership.GetString("user"),
+			"role": membership.GetString("role"),
+		}
+		if user := membership.ExpandedOne("user"); user != nil {
+			member["name"] = user.GetString("name")
+			member["username"] = user.GetString("username")
+			member["avatar_url"] = user.GetString("avatar_url")
+		}
+		members = append(members, member)
+	}
+
+	return c.JSON(200, map[string]any{"members": members})
+}
+
+// Add a member to a department or group, or change their role
+func handleSetMember(c *core.RequestEvent, app *pocketbase.PocketBase, collection string) error {
+	var requestBody struct {
+		Role string `json:"role"`
+	}
+	if err := c.BindBody(&requestBody); err != nil {
+		return c.JSON(400, map[string]string{"error": "invalid request body"})
+	}
+	if requestBody.Role == "" {
+		requestBody.Role = roleMember
+	}
+	if !slices.Contains(membershipRoles, requestBody.Role) {
+		return c.JSON(400, map[string]string{"error": "role must be member, lead or manager"})
+	}
+
+	record, err := app.FindRecordById(collection, c.Request.PathValue("id"))
+	if err != nil {
+		return c.JSON(404, map[string]string{"error": "not found"})
+	}
+
+	if !canManageMembers(c, app, collection, record.Id) {
+		return c.JSON(403, map[string]string{"error": "not allowed to manage the members"})
+	}
+
+	user, err := app.FindRecordById("users", c.Request.PathValue("user"))
+	if err != nil {
+		return c.JSON(404, map[string]string{"error": "user not found"})
+	}
+
+	field := membershipField(collection)
+	membership, err := app.FindFirstRecordByFilter(
+		membershipsCollection,
+		field+" = {:id} && user = {:user}",
+		dbx.Params{"id": record.Id, "user": user.Id},
+	)
+	if err != nil {
+		memberships, err := app.FindCollectionByNameOrId(membershipsCollection)
+		if err != nil {
+			return c.JSON(500, map[string]string{"error": "memberships collection not found"})
+		}
+		membership = core.NewRecord(memberships)
+		membership.Set("user", user.Id)
+		membership.Set(field, record.Id)
+	}
+
+	membership.Set("role", requestBody.Role)
+	if err := app.SaveWithContext(withAuditActor(context.Background(), requestAuditActor(c)), membership); err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to save the member"})
+	}
+
+	return c.JSON(200, map[string]any{
+		"success": true,
+		"id":      membership.Id,
+		"user":    user.Id,
+		"role":    requestBody.Role,
+	})
+}
+
+// Remove a member from a department or group
+func handleRemoveMember(c *core.RequestEvent, app *pocketbase.PocketBase, collection string) error {
+	record, err := app.FindRecordById(collection, c.Request.PathValue("id"))
+	if err != nil {
+		return c.JSON(404, map[string]string{"error": "not found"})
+	}
+
+	if !canManageMembers(c, app, collection, record.Id) {
+		return c.JSON(403, map[string]string{"error": "not allowed to manage the members"})
+	}
+
+	membership, err := app.FindFirstRecordByFilter(
+		membershipsCollection,
+		membershipField(collection)+" = {:id} && user = {:user}",
+		dbx.Params{"id": record.Id, "user": c.Request.PathValue("user")},
+	)
+	if err != nil {
+		return c.JSON(404, map[string]string{"error": "member not found"})
+	}
+
+	if err := app.DeleteWithContext(withAuditActor(context.Background(), requestAuditActor(c)), membership); err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to remove the member"})
+	}
+
+	return c.JSON(200, map[string]any{"success": true})
+}
@@ -0,0 +1,255 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Roles every instance needs, new Mattermost users get "member"
+var defaultRoles = []string{"member", "admin"}
+
+// Find the collection or start a new base collection
+func ensureCollection(app core.App, name string) *core.Collection {
+	collection, err := app.FindCollectionByNameOrId(name)
+	if err == nil {
+		return collection
+	}
+
+	return core.NewBaseCollection(name)
+}
+
+// API rules of a collection, nil is superusers only
+type collectionRules struct {
+	List   *string
+	View   *string
+	Create *string
+	Update *string
+	Delete *string
+}
+
+// Set the rules the app relies on where the collection is still superusers only.
+// Rules set on the instance or by a later migration (eg. the task member rules)
+// are kept, on the instances created before this migration it runs last.
+func ensureRules(collection *core.Collection, rules collectionRules) {
+	fill := func(current **string, rule *string) {
+		if *current == nil {
+			*current = rule
+		}
+	}
+
+	fill(&collection.ListRule, rules.List)
+	fill(&collection.ViewRule, rules.View)
+	fill(&collection.CreateRule, rules.Create)
+	fill(&collection.UpdateRule, rules.Update)
+	fill(&collection.DeleteRule, rules.Delete)
+}
+
+// Add the fields missing from the collection, existing fields are left as they are
+func ensureFields(collection *core.Collection, fields ...core.Field) {
+	for _, field := range fields {
+		if collection.Fields.GetByName(field.GetName()) == nil {
+			collection.Fields.Add(field)
+		}
+	}
+}
+
+// Add the index unless the collection has one with the same name
+func ensureIndex(collection *core.Collection, name string, unique bool, columns string, where string) {
+	if collection.GetIndex(name) == "" {
+		collection.AddIndex(name, unique, columns, where)
+	}
+}
+
+func ensureTimestamps(collection *core.Collection) {
+	ensureFields(collection,
+		&core.AutodateField{Name: "created", OnCreate: true},
+		&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+	)
+}
+
+// The base schema of the app: roles, departments, groups, the custom user fields,
+// tasks, feedbacks and the OAuth exchange sessions. Instances created before the
+// migrations keep their collections, only the missing fields are added.
+func init() {
+	m.Register(func(app core.App) error {
+		authRule := types.Pointer("@request.auth.id != ''")
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// pick the assignees and members among all the users
+		ownRecordRule := "id = @request.auth.id"
+		if users.ListRule != nil && *users.ListRule == ownRecordRule {
+			users.ListRule = authRule
+		}
+		if users.ViewRule != nil && *users.ViewRule == ownRecordRule {
+			users.ViewRule = authRule
+		}
+
+		// roles
+		roles := ensureCollection(app, "roles")
+		ensureRules(roles, collectionRules{List: authRule, View: authRule})
+		ensureFields(roles,
+			&core.TextField{Name: "name", Required: true},
+			&core.TextField{Name: "code", Required: true},
+		)
+		ensureTimestamps(roles)
+		ensureIndex(roles, "idx_roles_code", true, "code", "")
+		if err := app.Save(roles); err != nil {
+			return err
+		}
+
+		for _, code := range defaultRoles {
+			if _, err := app.FindFirstRecordByFilter(roles, "code = {:code}", dbx.Params{"code": code}); err == nil {
+				continue
+			}
+			role := core.NewRecord(roles)
+			role.Set("name", code)
+			role.Set("code", code)
+			if err := app.Save(role); err != nil {
+				return err
+			}
+		}
+
+		// departments and groups
+		// written with the department.manage permission (see 1792131300_added_role_permissions.go)
+		departments := ensureCollection(app, "departments")
+		ensureRules(departments, collectionRules{List: authRule, View: authRule})
+		ensureFields(departments,
+			&core.TextField{Name: "name", Required: true},
+			&core.TextField{Name: "code"},
+			&core.TextField{Name: "mattermost_channel"},
+		)
+		ensureTimestamps(departments)
+		ensureIndex(departments, "idx_departments_code", true, "code", "code != ''")
+		if err := app.Save(departments); err != nil {
+			return err
+		}
+
+		groups := ensureCollection(app, "groups")
+		ensureRules(groups, collectionRules{List: authRule, View: authRule})
+		ensureFields(groups,
+			&core.TextField{Name: "name", Required: true},
+			&core.TextField{Name: "code"},
+		)
+		ensureTimestamps(groups)
+		ensureIndex(groups, "idx_groups_code", true, "code", "code != ''")
+		if err := app.Save(groups); err != nil {
+			return err
+		}
+
+		// custom user fields, filled from Mattermost
+		ensureFields(users,
+			&core.TextField{Name: "username"},
+			&core.TextField{Name: "mm_channel"},
+			&core.TextField{Name: "avatar_url"},
+			&core.TextField{Name: "phoneNumber"},
+			&core.SelectField{
+				Name:      "status",
+				MaxSelect: 1,
+				Values:    []string{"active", "inactive", "invited", "suspended"},
+			},
+			&core.RelationField{
+				Name:         "roles",
+				CollectionId: roles.Id,
+				MaxSelect:    10,
+			},
+		)
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		// tasks, with PQQ00000 ids. The member and manager rules and the create rule
+		// come with the memberships and the permissions.
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			tasks = core.NewBaseCollection("tasks")
+			if id, ok := tasks.Fields.GetByName("id").(*core.TextField); ok {
+				id.AutogeneratePattern = "PQQ[0-9]{5}"
+				id.Pattern = "PQQ[0-9]{5}"
+				id.Min = 8
+				id.Max = 8
+			}
+		}
+		ensureRules(tasks, collectionRules{
+			List:   authRule,
+			View:   authRule,
+			Update: authRule,
+			Delete: types.Pointer("@request.auth.id != '' && createdBy = @request.auth.id"),
+		})
+		ensureFields(tasks,
+			&core.TextField{Name: "title"},
+			&core.EditorField{Name: "description"},
+		)
+		ensureTimestamps(tasks)
+		ensureFields(tasks,
+			&core.SelectField{
+				Name:      "status",
+				MaxSelect: 1,
+				Values:    []string{"backlog", "todo", "in_progress", "done", "canceled"},
+			},
+			&core.TextField{Name: "label"},
+			&core.RelationField{Name: "assignees", CollectionId: users.Id, MaxSelect: 99},
+			&core.RelationField{Name: "departments", CollectionId: departments.Id, MaxSelect: 99},
+			&core.DateField{Name: "due_date"},
+			&core.RelationField{Name: "createdBy", CollectionId: users.Id, MaxSelect: 1},
+			&core.RelationField{Name: "updatedBy", CollectionId: users.Id, MaxSelect: 1},
+		)
+		ensureIndex(tasks, "idx_tasks_status", false, "status", "")
+		ensureIndex(tasks, "idx_tasks_due_date", false, "due_date", "")
+		if err := app.Save(tasks); err != nil {
+			return err
+		}
+
+		// feedbacks of the tasks
+		senderRule := types.Pointer("@request.auth.id != '' && sender = @request.auth.id")
+		feedbacks := ensureCollection(app, "feedbacks")
+		ensureRules(feedbacks, collectionRules{
+			List:   authRule,
+			View:   authRule,
+			Create: senderRule,
+			Update: senderRule,
+			Delete: senderRule,
+		})
+		ensureFields(feedbacks,
+			&core.TextField{Name: "message"},
+			&core.SelectField{
+				Name:      "type",
+				MaxSelect: 1,
+				Values:    []string{"comment", "report"},
+			},
+			&core.RelationField{Name: "sender", CollectionId: users.Id, MaxSelect: 1},
+			&core.RelationField{Name: "task", CollectionId: tasks.Id, MaxSelect: 1, CascadeDelete: true},
+			&core.DateField{Name: "timestamp"},
+		)
+		ensureTimestamps(feedbacks)
+		ensureIndex(feedbacks, "idx_feedbacks_task", false, "task", "")
+		if err := app.Save(feedbacks); err != nil {
+			return err
+		}
+
+		// one-time codes exchanged for an auth token after the Mattermost login, superusers only
+		sessions := ensureCollection(app, "oauth_sessions")
+		ensureFields(sessions,
+			&core.TextField{Name: "code", Required: true},
+			&core.RelationField{Name: "user", CollectionId: users.Id, MaxSelect: 1, Required: true, CascadeDelete: true},
+			&core.BoolField{Name: "used"},
+			&core.TextField{Name: "state"},
+			&core.DateField{Name: "expiresAt"},
+		)
+		ensureTimestamps(sessions)
+		ensureIndex(sessions, "idx_oauth_sessions_code", true, "code", "")
+		ensureIndex(sessions, "idx_oauth_sessions_state", false, "state", "")
+
+		return app.Save(sessions)
+	}, func(app core.App) error {
+		// Not reverted: on the instances created before the migrations these
+		// collections and fields hold the app data and dropping them would lose it.
+		// A new instance is reset by starting from an empty pb_data instead.
+		return nil
+	})
+}
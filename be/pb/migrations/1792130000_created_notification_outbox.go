@@ -0,0 +1,47 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("notification_outbox")
+
+		collection.Fields.Add(
+			&core.TextField{Name: "channel_id", Required: true},
+			&core.TextField{Name: "message", Required: true},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"pending", "sent", "dead"},
+			},
+			&core.NumberField{Name: "attempts", OnlyInt: true},
+			&core.DateField{Name: "next_attempt_at"},
+			&core.TextField{Name: "last_error"},
+			&core.TextField{Name: "post_id"},
+			&core.RelationField{Name: "task", CollectionId: tasks.Id, MaxSelect: 1},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+
+		collection.AddIndex("idx_notification_outbox_due", false, "status, next_attempt_at", "")
+
+		// superusers only
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		return app.Delete(collection)
+	})
+}
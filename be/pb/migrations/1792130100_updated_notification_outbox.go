@@ -0,0 +1,41 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		collection.Fields.Add(
+			&core.SelectField{
+				Name:      "recipient_type",
+				MaxSelect: 1,
+				Values:    []string{"user", "department", "channel"},
+			},
+			&core.TextField{Name: "recipient_id"},
+			&core.NumberField{Name: "last_status", OnlyInt: true},
+		)
+
+		collection.AddIndex("idx_notification_outbox_task", false, "task", "")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		collection.Fields.RemoveByName("recipient_type")
+		collection.Fields.RemoveByName("recipient_id")
+		collection.Fields.RemoveByName("last_status")
+		collection.RemoveIndex("idx_notification_outbox_task")
+
+		return app.Save(collection)
+	})
+}
@@ -0,0 +1,43 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("task_reminders")
+
+		collection.Fields.Add(
+			&core.RelationField{
+				Name:          "task",
+				CollectionId:  tasks.Id,
+				MaxSelect:     1,
+				Required:      true,
+				CascadeDelete: true,
+			},
+			// "before:24h", "before:1h", "overdue", ...
+			&core.TextField{Name: "kind", Required: true},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+
+		collection.AddIndex("idx_task_reminders_task_kind", true, "task, kind", "")
+
+		// superusers only
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("task_reminders")
+		if err != nil {
+			return err
+		}
+
+		return app.Delete(collection)
+	})
+}
@@ -0,0 +1,148 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// outbox entries are no longer Mattermost only
+		outbox, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		outbox.Fields.GetByName("channel_id").SetName("address")
+		outbox.Fields.Add(&core.SelectField{
+			Name:      "notifier",
+			MaxSelect: 1,
+			Values:    []string{"mattermost", "email", "webhook", "inapp"},
+		})
+
+		if err := app.Save(outbox); err != nil {
+			return err
+		}
+
+		if _, err := app.DB().NewQuery("UPDATE {{notification_outbox}} SET [[notifier]] = 'mattermost' WHERE [[notifier]] = ''").Execute(); err != nil {
+			return err
+		}
+
+		// per user and per department routing
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.Add(
+			&core.SelectField{
+				Name:      "notify_via",
+				MaxSelect: 4,
+				Values:    []string{"mattermost", "email", "webhook", "inapp"},
+			},
+			&core.URLField{Name: "webhook_url"},
+		)
+
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		departments, err := app.FindCollectionByNameOrId("departments")
+		if err != nil {
+			return err
+		}
+
+		departments.Fields.Add(
+			&core.SelectField{
+				Name:      "notify_via",
+				MaxSelect: 3,
+				Values:    []string{"mattermost", "email", "webhook"},
+			},
+			&core.EmailField{Name: "email"},
+			&core.URLField{Name: "webhook_url"},
+		)
+
+		if err := app.Save(departments); err != nil {
+			return err
+		}
+
+		// in-app notifications
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		notifications := core.NewBaseCollection("notifications")
+
+		notifications.ListRule = types.Pointer("user = @request.auth.id")
+		notifications.ViewRule = types.Pointer("user = @request.auth.id")
+		// only allow marking as read
+		notifications.UpdateRule = types.Pointer("user = @request.auth.id && @request.body.user:changed = false && @request.body.title:changed = false && @request.body.message:changed = false && @request.body.task:changed = false")
+		notifications.DeleteRule = types.Pointer("user = @request.auth.id")
+
+		notifications.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				MaxSelect:     1,
+				Required:      true,
+				CascadeDelete: true,
+			},
+			&core.TextField{Name: "title"},
+			&core.TextField{Name: "message"},
+			&core.RelationField{Name: "task", CollectionId: tasks.Id, MaxSelect: 1},
+			&core.BoolField{Name: "read"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+
+		notifications.AddIndex("idx_notifications_user_read", false, "user, read", "")
+
+		return app.Save(notifications)
+	}, func(app core.App) error {
+		notifications, err := app.FindCollectionByNameOrId("notifications")
+		if err != nil {
+			return err
+		}
+
+		if err := app.Delete(notifications); err != nil {
+			return err
+		}
+
+		departments, err := app.FindCollectionByNameOrId("departments")
+		if err != nil {
+			return err
+		}
+
+		departments.Fields.RemoveByName("notify_via")
+		departments.Fields.RemoveByName("email")
+		departments.Fields.RemoveByName("webhook_url")
+
+		if err := app.Save(departments); err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("notify_via")
+		users.Fields.RemoveByName("webhook_url")
+
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		outbox, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		outbox.Fields.RemoveByName("notifier")
+		outbox.Fields.GetByName("address").SetName("channel_id")
+
+		return app.Save(outbox)
+	})
+}
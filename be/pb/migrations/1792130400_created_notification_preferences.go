@@ -0,0 +1,92 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// IANA name of the user's Mattermost timezone
+		users.Fields.Add(&core.TextField{Name: "timezone"})
+
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("notification_preferences")
+
+		collection.ListRule = types.Pointer("user = @request.auth.id")
+		collection.ViewRule = types.Pointer("user = @request.auth.id")
+		collection.CreateRule = types.Pointer("@request.auth.id != '' && user = @request.auth.id")
+		collection.UpdateRule = types.Pointer("user = @request.auth.id && @request.body.user:changed = false")
+		collection.DeleteRule = types.Pointer("user = @request.auth.id")
+
+		collection.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				MaxSelect:     1,
+				Required:      true,
+				CascadeDelete: true,
+			},
+			// empty means every event
+			&core.SelectField{
+				Name:      "events",
+				MaxSelect: 7,
+				Values: []string{
+					"task_created",
+					"task_assigned",
+					"task_unassigned",
+					"task_status",
+					"task_due_changed",
+					"task_reminder",
+					"task_overdue",
+				},
+			},
+			// empty means the user's notify_via
+			&core.SelectField{
+				Name:      "channels",
+				MaxSelect: 4,
+				Values:    []string{"mattermost", "email", "webhook", "inapp"},
+			},
+			&core.SelectField{
+				Name:      "delivery",
+				MaxSelect: 1,
+				Values:    []string{"immediate", "digest"},
+			},
+			&core.TextField{Name: "quiet_start", Pattern: `^([01]\d|2[0-3]):[0-5]\d$`},
+			&core.TextField{Name: "quiet_end", Pattern: `^([01]\d|2[0-3]):[0-5]\d$`},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+
+		collection.AddIndex("idx_notification_preferences_user", true, "user", "")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_preferences")
+		if err != nil {
+			return err
+		}
+
+		if err := app.Delete(collection); err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("timezone")
+
+		return app.Save(users)
+	})
+}
@@ -0,0 +1,116 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		tasks.Fields.Add(&core.DateField{Name: "completed_at"})
+
+		if err := app.Save(tasks); err != nil {
+			return err
+		}
+
+		departments, err := app.FindCollectionByNameOrId("departments")
+		if err != nil {
+			return err
+		}
+
+		departments.Fields.Add(
+			// cron expression in the server timezone, empty disables the digest
+			&core.TextField{Name: "digest_schedule"},
+			// empty means every section
+			&core.SelectField{
+				Name:      "digest_sections",
+				MaxSelect: 4,
+				Values:    []string{"open", "due_this_week", "overdue", "completed"},
+			},
+		)
+
+		if err := app.Save(departments); err != nil {
+			return err
+		}
+
+		preferences, err := app.FindCollectionByNameOrId("notification_preferences")
+		if err != nil {
+			return err
+		}
+
+		preferences.Fields.Add(&core.SelectField{
+			Name:      "digest",
+			MaxSelect: 1,
+			Values:    []string{"daily", "weekly", "off"},
+		})
+
+		if err := app.Save(preferences); err != nil {
+			return err
+		}
+
+		digests := core.NewBaseCollection("digests")
+
+		digests.Fields.Add(
+			&core.SelectField{
+				Name:      "target_type",
+				Required:  true,
+				MaxSelect: 1,
+				Values:    []string{"user", "department"},
+			},
+			&core.TextField{Name: "target_id", Required: true},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+
+		digests.AddIndex("idx_digests_target", false, "target_type, target_id, created", "")
+
+		// superusers only
+		return app.Save(digests)
+	}, func(app core.App) error {
+		digests, err := app.FindCollectionByNameOrId("digests")
+		if err != nil {
+			return err
+		}
+
+		if err := app.Delete(digests); err != nil {
+			return err
+		}
+
+		preferences, err := app.FindCollectionByNameOrId("notification_preferences")
+		if err != nil {
+			return err
+		}
+
+		preferences.Fields.RemoveByName("digest")
+
+		if err := app.Save(preferences); err != nil {
+			return err
+		}
+
+		departments, err := app.FindCollectionByNameOrId("departments")
+		if err != nil {
+			return err
+		}
+
+		departments.Fields.RemoveByName("digest_schedule")
+		departments.Fields.RemoveByName("digest_sections")
+
+		if err := app.Save(departments); err != nil {
+			return err
+		}
+
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		tasks.Fields.RemoveByName("completed_at")
+
+		return app.Save(tasks)
+	})
+}
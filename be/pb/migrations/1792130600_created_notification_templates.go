@@ -0,0 +1,69 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// Mattermost locale of the user, eg. "vi" or "en"
+		users.Fields.Add(&core.TextField{Name: "locale"})
+
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		// superusers only, the built-in templates are used for the events/locales without a record
+		collection := core.NewBaseCollection("notification_templates")
+
+		collection.Fields.Add(
+			&core.SelectField{
+				Name:      "event",
+				MaxSelect: 1,
+				Required:  true,
+				Values: []string{
+					"task_created",
+					"task_assigned",
+					"task_unassigned",
+					"task_status",
+					"task_due_changed",
+					"task_reminder",
+					"task_overdue",
+				},
+			},
+			&core.TextField{Name: "locale", Required: true, Max: 16},
+			// text/template source, see notification.TemplateData
+			&core.TextField{Name: "body", Required: true},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+
+		collection.AddIndex("idx_notification_templates_event_locale", true, "event, locale", "")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_templates")
+		if err != nil {
+			return err
+		}
+
+		if err := app.Delete(collection); err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("locale")
+
+		return app.Save(users)
+	})
+}
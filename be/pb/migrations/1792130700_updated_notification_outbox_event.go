@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		// event the message is about, empty for free-form messages
+		collection.Fields.Add(&core.TextField{Name: "event"})
+
+		// task action buttons look up the post they were clicked on
+		collection.AddIndex("idx_notification_outbox_post_id", false, "post_id", "")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		collection.Fields.RemoveByName("event")
+		collection.RemoveIndex("idx_notification_outbox_post_id")
+
+		return app.Save(collection)
+	})
+}
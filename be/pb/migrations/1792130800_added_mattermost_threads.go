@@ -0,0 +1,83 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		// Mattermost announcement of the task, feedbacks are threaded under it
+		tasks.Fields.Add(
+			&core.TextField{Name: "mm_post_id"},
+			&core.TextField{Name: "mm_channel_id"},
+		)
+		tasks.AddIndex("idx_tasks_mm_post_id", false, "mm_post_id", "")
+
+		if err := app.Save(tasks); err != nil {
+			return err
+		}
+
+		feedbacks, err := app.FindCollectionByNameOrId("feedbacks")
+		if err != nil {
+			return err
+		}
+
+		// Mattermost thread reply the feedback came from
+		feedbacks.Fields.Add(&core.TextField{Name: "mm_post_id"})
+		feedbacks.AddIndex("idx_feedbacks_mm_post_id", false, "mm_post_id", "")
+
+		if err := app.Save(feedbacks); err != nil {
+			return err
+		}
+
+		outbox, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		// Mattermost post the message replies to
+		outbox.Fields.Add(&core.TextField{Name: "root_id"})
+
+		return app.Save(outbox)
+	}, func(app core.App) error {
+		outbox, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		outbox.Fields.RemoveByName("root_id")
+
+		if err := app.Save(outbox); err != nil {
+			return err
+		}
+
+		feedbacks, err := app.FindCollectionByNameOrId("feedbacks")
+		if err != nil {
+			return err
+		}
+
+		feedbacks.Fields.RemoveByName("mm_post_id")
+		feedbacks.RemoveIndex("idx_feedbacks_mm_post_id")
+
+		if err := app.Save(feedbacks); err != nil {
+			return err
+		}
+
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		tasks.Fields.RemoveByName("mm_post_id")
+		tasks.Fields.RemoveByName("mm_channel_id")
+		tasks.RemoveIndex("idx_tasks_mm_post_id")
+
+		return app.Save(tasks)
+	})
+}
@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// secret of the user's calendar feed URL
+		users.Fields.Add(&core.TextField{Name: "calendar_token", Hidden: true})
+		users.AddIndex("idx_users_calendar_token", true, "calendar_token", "calendar_token != ''")
+
+		return app.Save(users)
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.Fields.RemoveByName("calendar_token")
+		users.RemoveIndex("idx_users_calendar_token")
+
+		return app.Save(users)
+	})
+}
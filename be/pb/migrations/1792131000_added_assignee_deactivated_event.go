@@ -0,0 +1,66 @@
+package migrations
+
+import (
+	"slices"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Collections with a select field of the notification events
+var notificationEventFields = map[string]string{
+	"notification_preferences": "events",
+	"notification_templates":   "event",
+}
+
+func init() {
+	m.Register(func(app core.App) error {
+		for name, fieldName := range notificationEventFields {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+
+			field, ok := collection.Fields.GetByName(fieldName).(*core.SelectField)
+			if !ok {
+				continue
+			}
+			if !slices.Contains(field.Values, "task_assignee_deactivated") {
+				field.Values = append(field.Values, "task_assignee_deactivated")
+			}
+			if field.MaxSelect > 1 {
+				field.MaxSelect = len(field.Values)
+			}
+
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(app core.App) error {
+		for name, fieldName := range notificationEventFields {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+
+			field, ok := collection.Fields.GetByName(fieldName).(*core.SelectField)
+			if !ok {
+				continue
+			}
+			field.Values = slices.DeleteFunc(field.Values, func(value string) bool {
+				return value == "task_assignee_deactivated"
+			})
+			if field.MaxSelect > 1 {
+				field.MaxSelect = len(field.Values)
+			}
+
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,110 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Tasks are visible to their creator, their assignees and the members of their departments.
+// The department managers can also change them, eg. to reassign.
+const (
+	taskMemberRule  = "@request.auth.id != '' && (createdBy = @request.auth.id || assignees.id ?= @request.auth.id || (@collection.memberships:member.user ?= @request.auth.id && @collection.memberships:member.department ?= departments.id))"
+	taskManagerRule = "@request.auth.id != '' && (createdBy = @request.auth.id || assignees.id ?= @request.auth.id || (@collection.memberships:manager.user ?= @request.auth.id && @collection.memberships:manager.department ?= departments.id && @collection.memberships:manager.role ?= 'manager'))"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		departments, err := app.FindCollectionByNameOrId("departments")
+		if err != nil {
+			return err
+		}
+
+		groups, err := app.FindCollectionByNameOrId("groups")
+		if err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("memberships")
+
+		collection.ListRule = types.Pointer("@request.auth.id != ''")
+		collection.ViewRule = types.Pointer("@request.auth.id != ''")
+		// create/update/delete: superusers only, the managers use /api/{departments,groups}/{id}/members
+
+		collection.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				MaxSelect:     1,
+				Required:      true,
+				CascadeDelete: true,
+			},
+			// either a department or a group
+			&core.RelationField{
+				Name:          "department",
+				CollectionId:  departments.Id,
+				MaxSelect:     1,
+				CascadeDelete: true,
+			},
+			&core.RelationField{
+				Name:          "group",
+				CollectionId:  groups.Id,
+				MaxSelect:     1,
+				CascadeDelete: true,
+			},
+			&core.SelectField{
+				Name:      "role",
+				MaxSelect: 1,
+				Required:  true,
+				Values:    []string{"member", "lead", "manager"},
+			},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+
+		collection.AddIndex("idx_memberships_user_department", true, "`user`, `department`", "`department` != ''")
+		collection.AddIndex("idx_memberships_user_group", true, "`user`, `group`", "`group` != ''")
+		collection.AddIndex("idx_memberships_department", false, "`department`", "")
+		collection.AddIndex("idx_memberships_group", false, "`group`", "")
+
+		if err := app.Save(collection); err != nil {
+			return err
+		}
+
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		tasks.ListRule = types.Pointer(taskMemberRule)
+		tasks.ViewRule = types.Pointer(taskMemberRule)
+		tasks.UpdateRule = types.Pointer(taskManagerRule)
+
+		return app.Save(tasks)
+	}, func(app core.App) error {
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		tasks.ListRule = types.Pointer("@request.auth.id != null")
+		tasks.ViewRule = nil
+		tasks.UpdateRule = nil
+
+		if err := app.Save(tasks); err != nil {
+			return err
+		}
+
+		collection, err := app.FindCollectionByNameOrId("memberships")
+		if err != nil {
+			return err
+		}
+
+		return app.Delete(collection)
+	})
+}
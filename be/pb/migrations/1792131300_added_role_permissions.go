@@ -0,0 +1,94 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+var rolePermissions = []string{
+	"task.create",
+	"task.assign.any",
+	"task.export",
+	"department.manage",
+	"mattermost.post",
+}
+
+// Permissions of the existing roles
+var defaultRolePermissions = map[string][]string{
+	"member": {"task.create", "task.export", "mattermost.post"},
+	"admin":  rolePermissions,
+}
+
+func init() {
+	m.Register(func(app core.App) error {
+		roles, err := app.FindCollectionByNameOrId("roles")
+		if err != nil {
+			return err
+		}
+
+		roles.Fields.Add(&core.SelectField{
+			Name:      "permissions",
+			MaxSelect: len(rolePermissions),
+			Values:    rolePermissions,
+		})
+
+		if err := app.Save(roles); err != nil {
+			return err
+		}
+
+		for code, permissions := range defaultRolePermissions {
+			role, err := app.FindFirstRecordByFilter(roles, "code = {:code}", dbx.Params{"code": code})
+			if err != nil {
+				continue
+			}
+			role.Set("permissions", permissions)
+			if err := app.Save(role); err != nil {
+				return err
+			}
+		}
+
+		// the task.create and department.manage permissions are checked by the request hooks
+		for _, name := range []string{"tasks", "departments", "groups"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			collection.CreateRule = types.Pointer("@request.auth.id != ''")
+			if name != "tasks" {
+				collection.UpdateRule = types.Pointer("@request.auth.id != ''")
+				collection.DeleteRule = types.Pointer("@request.auth.id != ''")
+			}
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(app core.App) error {
+		for _, name := range []string{"tasks", "departments", "groups"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			collection.CreateRule = nil
+			if name != "tasks" {
+				collection.UpdateRule = nil
+				collection.DeleteRule = nil
+			}
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+
+		roles, err := app.FindCollectionByNameOrId("roles")
+		if err != nil {
+			return err
+		}
+
+		roles.Fields.RemoveByName("permissions")
+
+		return app.Save(roles)
+	})
+}
@@ -0,0 +1,55 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("mattermost_post_audit")
+
+		// superusers only
+
+		collection.Fields.Add(
+			// empty for superusers, see actor
+			&core.RelationField{
+				Name:         "user",
+				CollectionId: users.Id,
+				MaxSelect:    1,
+			},
+			&core.TextField{Name: "actor"},
+			&core.JSONField{Name: "channel_ids"},
+			&core.TextField{Name: "message"},
+			&core.SelectField{
+				Name:      "status",
+				MaxSelect: 1,
+				Required:  true,
+				Values:    []string{"sent", "partial", "failed", "rejected"},
+			},
+			&core.JSONField{Name: "sent"},
+			&core.JSONField{Name: "failed"},
+			&core.TextField{Name: "error"},
+			&core.TextField{Name: "ip"},
+			&core.TextField{Name: "user_agent"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+		)
+
+		collection.AddIndex("idx_mattermost_post_audit_user", false, "user, created", "")
+		collection.AddIndex("idx_mattermost_post_audit_created", false, "created", "")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("mattermost_post_audit")
+		if err != nil {
+			return err
+		}
+
+		return app.Delete(collection)
+	})
+}
@@ -0,0 +1,105 @@
+package migrations
+
+import (
+	"slices"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		collection := core.NewBaseCollection("audit_log")
+
+		// superusers only, read through /api/audit
+
+		collection.Fields.Add(
+			&core.TextField{Name: "collection", Required: true},
+			&core.TextField{Name: "record", Required: true},
+			&core.SelectField{
+				Name:      "action",
+				MaxSelect: 1,
+				Required:  true,
+				Values:    []string{"create", "update", "delete"},
+			},
+			// id of the user or superuser, empty for system changes.
+			// Not a relation, deleting a user must not touch their entries.
+			&core.TextField{Name: "actor"},
+			&core.SelectField{
+				Name:      "actor_type",
+				MaxSelect: 1,
+				Values:    []string{"user", "superuser", "system"},
+			},
+			&core.TextField{Name: "actor_name"},
+			// {"field": {"old": ..., "new": ...}}
+			&core.JSONField{Name: "changes"},
+			&core.TextField{Name: "ip"},
+			&core.TextField{Name: "user_agent"},
+			&core.TextField{Name: "method"},
+			&core.TextField{Name: "path"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+		)
+
+		collection.AddIndex("idx_audit_log_record", false, "collection, record, created", "")
+		collection.AddIndex("idx_audit_log_actor", false, "actor, created", "")
+		collection.AddIndex("idx_audit_log_created", false, "created", "")
+
+		if err := app.Save(collection); err != nil {
+			return err
+		}
+
+		// let the admins read the audit log
+		roles, err := app.FindCollectionByNameOrId("roles")
+		if err != nil {
+			return err
+		}
+
+		field, ok := roles.Fields.GetByName("permissions").(*core.SelectField)
+		if ok && !slices.Contains(field.Values, "audit.view") {
+			field.Values = append(field.Values, "audit.view")
+			field.MaxSelect = len(field.Values)
+			if err := app.Save(roles); err != nil {
+				return err
+			}
+		}
+
+		admin, err := app.FindFirstRecordByFilter(roles, "code = {:code}", dbx.Params{"code": "admin"})
+		if err == nil {
+			admin.Set("permissions+", "audit.view")
+			if err := app.Save(admin); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(app core.App) error {
+		roles, err := app.FindCollectionByNameOrId("roles")
+		if err != nil {
+			return err
+		}
+
+		admin, err := app.FindFirstRecordByFilter(roles, "code = {:code}", dbx.Params{"code": "admin"})
+		if err == nil {
+			admin.Set("permissions-", "audit.view")
+			if err := app.Save(admin); err != nil {
+				return err
+			}
+		}
+
+		if field, ok := roles.Fields.GetByName("permissions").(*core.SelectField); ok {
+			field.Values = slices.DeleteFunc(field.Values, func(value string) bool { return value == "audit.view" })
+			field.MaxSelect = len(field.Values)
+			if err := app.Save(roles); err != nil {
+				return err
+			}
+		}
+
+		collection, err := app.FindCollectionByNameOrId("audit_log")
+		if err != nil {
+			return err
+		}
+
+		return app.Delete(collection)
+	})
+}
@@ -0,0 +1,59 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// Password once shared by every user created from a Mattermost login
+const legacyMattermostPassword = "tonkinhPhat1A@"
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// mattermost users sign in through the Mattermost login only
+		users.Fields.Add(&core.SelectField{
+			Name:      "auth_source",
+			MaxSelect: 1,
+			Values:    []string{"password", "mattermost"},
+		})
+
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		records, err := app.FindAllRecords(users)
+		if err != nil {
+			return err
+		}
+
+		// rotate the shared password, it also logs out their current sessions
+		for _, record := range records {
+			if !record.ValidatePassword(legacyMattermostPassword) {
+				continue
+			}
+			record.SetPassword(security.RandomString(40))
+			record.Set("auth_source", "mattermost")
+			if err := app.Save(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// the rotated passwords are not restored
+		users.Fields.RemoveByName("auth_source")
+
+		return app.Save(users)
+	})
+}
@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// id of the linked Mattermost account
+		users.Fields.Add(&core.TextField{Name: "mm_user_id"})
+		// why the Mattermost account couldn't be linked or its email updated, for a superuser to resolve
+		users.Fields.Add(&core.TextField{Name: "identity_conflict"})
+		users.AddIndex("idx_users_mm_user_id", true, "mm_user_id", "mm_user_id != ''")
+
+		if err := app.Save(users); err != nil {
+			return err
+		}
+
+		// users created by the Mattermost login have their Mattermost id (26 chars) as id
+		_, err = app.DB().Update(
+			users.Name,
+			dbx.Params{"mm_user_id": dbx.NewExp("id")},
+			dbx.NewExp("length(id) = 26 AND mm_user_id = ''"),
+		).Execute()
+
+		return err
+	}, func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.RemoveIndex("idx_users_mm_user_id")
+		users.Fields.RemoveByName("mm_user_id")
+		users.Fields.RemoveByName("identity_conflict")
+
+		return app.Save(users)
+	})
+}
@@ -0,0 +1,48 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		collection := core.NewBaseCollection("mattermost_tokens")
+
+		// superusers only
+
+		collection.Fields.Add(
+			&core.RelationField{
+				Name:          "user",
+				CollectionId:  users.Id,
+				MaxSelect:     1,
+				Required:      true,
+				CascadeDelete: true,
+			},
+			// encrypted with MATTERMOST_TOKEN_KEY
+			&core.TextField{Name: "access_token", Hidden: true},
+			&core.TextField{Name: "refresh_token", Hidden: true},
+			// empty when the access token doesn't expire
+			&core.DateField{Name: "expires_at"},
+			&core.AutodateField{Name: "created", OnCreate: true},
+			&core.AutodateField{Name: "updated", OnCreate: true, OnUpdate: true},
+		)
+
+		collection.AddIndex("idx_mattermost_tokens_user", true, "user", "")
+		collection.AddIndex("idx_mattermost_tokens_expires_at", false, "expires_at", "")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("mattermost_tokens")
+		if err != nil {
+			return err
+		}
+
+		return app.Delete(collection)
+	})
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		sessions, err := app.FindCollectionByNameOrId("oauth_sessions")
+		if err != nil {
+			return err
+		}
+
+		// SHA-256 of the secret kept by the browser that started the login,
+		// required to exchange the code
+		sessions.Fields.Add(&core.TextField{Name: "challenge"})
+
+		return app.Save(sessions)
+	}, func(app core.App) error {
+		sessions, err := app.FindCollectionByNameOrId("oauth_sessions")
+		if err != nil {
+			return err
+		}
+
+		sessions.Fields.RemoveByName("challenge")
+
+		return app.Save(sessions)
+	})
+}
@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		collection, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		// all the tasks of a consolidated message (tasks created in bulk)
+		collection.Fields.Add(&core.RelationField{Name: "tasks", CollectionId: tasks.Id, MaxSelect: 1000})
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		collection.Fields.RemoveByName("tasks")
+
+		return app.Save(collection)
+	})
+}
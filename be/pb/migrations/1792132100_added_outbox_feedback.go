@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		feedbacks, err := app.FindCollectionByNameOrId("feedbacks")
+		if err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		collection, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		// feedback thread replies are posted as their sender when possible,
+		// the post is stored on the feedback
+		collection.Fields.Add(
+			&core.RelationField{Name: "feedback", CollectionId: feedbacks.Id, MaxSelect: 1},
+			&core.RelationField{Name: "sender", CollectionId: users.Id, MaxSelect: 1},
+		)
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_outbox")
+		if err != nil {
+			return err
+		}
+
+		collection.Fields.RemoveByName("feedback")
+		collection.Fields.RemoveByName("sender")
+
+		return app.Save(collection)
+	})
+}
@@ -0,0 +1,49 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Stored preferences without events used to mean every event, they now opt out
+// of all of them. The existing preferences get every event to keep their meaning.
+func init() {
+	m.Register(func(app core.App) error {
+		return setPreferenceEvents(app, "events = '[]' OR events = ''", true)
+	}, func(app core.App) error {
+		return setPreferenceEvents(app, "json_array_length(events) = {:count}", false)
+	})
+}
+
+// Set the events of the matching preferences to every event, or to none
+func setPreferenceEvents(app core.App, where string, all bool) error {
+	collection, err := app.FindCollectionByNameOrId("notification_preferences")
+	if err != nil {
+		return err
+	}
+
+	field, ok := collection.Fields.GetByName("events").(*core.SelectField)
+	if !ok {
+		return nil
+	}
+
+	events := []string{}
+	if all {
+		events = field.Values
+	}
+	raw, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.DB().Update(
+		collection.Name,
+		dbx.Params{"events": string(raw)},
+		dbx.NewExp(where, dbx.Params{"count": len(field.Values)}),
+	).Execute()
+
+	return err
+}
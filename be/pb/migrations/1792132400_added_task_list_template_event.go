@@ -0,0 +1,41 @@
+package migrations
+
+import (
+	"slices"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// The "/task list" reply is rendered from templates too
+func init() {
+	m.Register(func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_templates")
+		if err != nil {
+			return err
+		}
+
+		field, ok := collection.Fields.GetByName("event").(*core.SelectField)
+		if !ok || slices.Contains(field.Values, "task_list") {
+			return nil
+		}
+		field.Values = append(field.Values, "task_list")
+
+		return app.Save(collection)
+	}, func(app core.App) error {
+		collection, err := app.FindCollectionByNameOrId("notification_templates")
+		if err != nil {
+			return err
+		}
+
+		field, ok := collection.Fields.GetByName("event").(*core.SelectField)
+		if !ok {
+			return nil
+		}
+		field.Values = slices.DeleteFunc(field.Values, func(value string) bool {
+			return value == "task_list"
+		})
+
+		return app.Save(collection)
+	})
+}
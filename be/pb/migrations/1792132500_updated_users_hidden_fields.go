@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// Every signed-in user can list the users, the delivery settings and the
+// Mattermost identity of the accounts are only shown to superusers
+var usersHiddenFields = []string{"notify_via", "webhook_url", "mm_user_id", "auth_source", "identity_conflict"}
+
+func init() {
+	m.Register(func(app core.App) error {
+		return setUsersFieldsHidden(app, true)
+	}, func(app core.App) error {
+		return setUsersFieldsHidden(app, false)
+	})
+}
+
+func setUsersFieldsHidden(app core.App, hidden bool) error {
+	users, err := app.FindCollectionByNameOrId("users")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range usersHiddenFields {
+		if field := users.Fields.GetByName(name); field != nil {
+			field.SetHidden(hidden)
+		}
+	}
+
+	return app.Save(users)
+}
@@ -0,0 +1,129 @@
+package notification
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// Task actions offered as buttons on Mattermost posts
+const (
+	ActionAccept = "accept"
+	ActionStart  = "start"
+	ActionDone   = "done"
+)
+
+// Status a task moves to for each action
+var ActionStatuses = map[string]string{
+	ActionAccept: "todo",
+	ActionStart:  "in_progress",
+	ActionDone:   "done",
+}
+
+var actionLabels = map[string]string{
+	ActionAccept: "Nhận việc",
+	ActionStart:  "Bắt đầu",
+	ActionDone:   "Hoàn thành",
+}
+
+// Actions that still make sense for a task status, all of them for a new task
+func availableActions(status string) []string {
+	switch status {
+	case "done", "canceled":
+		return []string{}
+	case "in_progress":
+		return []string{ActionDone}
+	case "todo":
+		return []string{ActionStart, ActionDone}
+	default:
+		return []string{ActionAccept, ActionStart, ActionDone}
+	}
+}
+
+// Tasks of a consolidated post getting buttons, like the task list of the message
+const bulkActionTaskLimit = 50
+
+// Task listed with its buttons on a consolidated post
+type ActionTask struct {
+	ID     string
+	Title  string
+	Status string
+}
+
+// TaskActionProps returns the post props with the action buttons for a task in the given status.
+// The buttons call POCKETBASE_SERVER_URL/api/mattermost/actions with a context signed
+// for the channel of the post. No buttons are added while MATTERMOST_ACTION_SECRET isn't set.
+func TaskActionProps(taskId string, status string, channelId string) map[string]any {
+	if os.Getenv("MATTERMOST_ACTION_SECRET") == "" {
+		return nil
+	}
+
+	actions := taskActions(taskId, status, channelId)
+
+	attachments := []map[string]any{}
+	if len(actions) > 0 {
+		attachments = append(attachments, map[string]any{"actions": actions})
+	}
+
+	return map[string]any{"attachments": attachments}
+}
+
+// BulkTaskActionProps returns the props of a consolidated post, one attachment per
+// task with its title, status and buttons
+func BulkTaskActionProps(tasks []ActionTask, channelId string) map[string]any {
+	if os.Getenv("MATTERMOST_ACTION_SECRET") == "" {
+		return nil
+	}
+
+	attachments := []map[string]any{}
+	for _, task := range tasks {
+		attachments = append(attachments, map[string]any{
+			"text":    fmt.Sprintf("**%s** - %s", task.Title, StatusLabel(task.Status, DefaultLocale())),
+			"actions": taskActions(task.ID, task.Status, channelId),
+		})
+	}
+
+	return map[string]any{"attachments": attachments}
+}
+
+func taskActions(taskId string, status string, channelId string) []map[string]any {
+	url := fmt.Sprintf("%s/api/mattermost/actions", os.Getenv("POCKETBASE_SERVER_URL"))
+
+	actions := []map[string]any{}
+	for _, action := range availableActions(status) {
+		actions = append(actions, map[string]any{
+			"id":   action,
+			"name": actionLabels[action],
+			"integration": map[string]any{
+				"url": url,
+				"context": map[string]any{
+					"task_id":    taskId,
+					"action":     action,
+					"channel_id": channelId,
+					"signature":  SignAction(taskId, action, channelId),
+				},
+			},
+		})
+	}
+
+	return actions
+}
+
+// SignAction returns the HMAC-SHA256 of the task action on a post of the channel
+// with MATTERMOST_ACTION_SECRET
+func SignAction(taskId string, action string, channelId string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("MATTERMOST_ACTION_SECRET")))
+	mac.Write([]byte(taskId + ":" + action + ":" + channelId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAction checks the signature of a task action coming back from Mattermost
+func VerifyAction(taskId string, action string, channelId string, signature string) bool {
+	if os.Getenv("MATTERMOST_ACTION_SECRET") == "" {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(SignAction(taskId, action, channelId)))
+}
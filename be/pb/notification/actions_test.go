@@ -0,0 +1,38 @@
+package notification
+
+import "testing"
+
+func TestSignAction(t *testing.T) {
+	t.Setenv("MATTERMOST_ACTION_SECRET", "secret")
+
+	signature := SignAction("PQQ00001", "done", "chan1")
+	if !VerifyAction("PQQ00001", "done", "chan1", signature) {
+		t.Fatal("expected the signature to be valid")
+	}
+
+	if VerifyAction("PQQ00001", "in_progress", "chan1", signature) {
+		t.Error("expected the signature of another action to be rejected")
+	}
+	if VerifyAction("PQQ00002", "done", "chan1", signature) {
+		t.Error("expected the signature of another task to be rejected")
+	}
+	if VerifyAction("PQQ00001", "done", "chan2", signature) {
+		t.Error("expected the signature of another channel to be rejected")
+	}
+	if VerifyAction("PQQ00001", "done", "chan1", "") {
+		t.Error("expected an empty signature to be rejected")
+	}
+
+	t.Setenv("MATTERMOST_ACTION_SECRET", "rotated")
+	if VerifyAction("PQQ00001", "done", "chan1", signature) {
+		t.Error("expected the signature of the previous secret to be rejected")
+	}
+}
+
+func TestVerifyActionWithoutSecret(t *testing.T) {
+	t.Setenv("MATTERMOST_ACTION_SECRET", "")
+
+	if VerifyAction("PQQ00001", "done", "chan1", SignAction("PQQ00001", "done", "chan1")) {
+		t.Fatal("expected the actions to be rejected without a secret")
+	}
+}
@@ -0,0 +1,61 @@
+package notification
+
+import (
+	"html"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+)
+
+// EmailNotifier sends notifications through the PocketBase mailer (SMTP settings of the app)
+type EmailNotifier struct {
+	app core.App
+}
+
+func NewEmailNotifier(app core.App) *EmailNotifier {
+	return &EmailNotifier{app: app}
+}
+
+func (n *EmailNotifier) Name() string {
+	return NotifierEmail
+}
+
+func (n *EmailNotifier) Send(msg Message) *PostResult {
+	result := &PostResult{ChannelID: msg.Recipient.Address}
+
+	meta := n.app.Settings().Meta
+	message := &mailer.Message{
+		From: mail.Address{
+			Name:    meta.SenderName,
+			Address: meta.SenderAddress,
+		},
+		To:      []mail.Address{{Address: msg.Recipient.Address}},
+		Subject: msg.Subject(),
+		HTML:    markdownToHTML(msg.Body),
+		Text:    strings.ReplaceAll(msg.Body, "**", ""),
+	}
+
+	if err := n.app.NewMailClient().Send(message); err != nil {
+		result.Error = err.Error()
+		result.Retryable = true
+	}
+
+	return result
+}
+
+var (
+	boldRegex = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	linkRegex = regexp.MustCompile(`https?://[^\s<]+`)
+)
+
+// Convert the small markdown subset used in notifications (bold, bare links, new lines) to HTML
+func markdownToHTML(text string) string {
+	escaped := html.EscapeString(text)
+	escaped = boldRegex.ReplaceAllString(escaped, "<strong>$1</strong>")
+	escaped = linkRegex.ReplaceAllString(escaped, `<a href="$0">$0</a>`)
+
+	return strings.ReplaceAll(escaped, "\n", "<br>\n")
+}
@@ -0,0 +1,48 @@
+package notification
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const InAppCollection = "notifications"
+
+// InAppNotifier stores notifications in the "notifications" collection,
+// the frontend lists them and receives new ones over realtime subscriptions.
+type InAppNotifier struct {
+	app core.App
+}
+
+func NewInAppNotifier(app core.App) *InAppNotifier {
+	return &InAppNotifier{app: app}
+}
+
+func (n *InAppNotifier) Name() string {
+	return NotifierInApp
+}
+
+func (n *InAppNotifier) Send(msg Message) *PostResult {
+	result := &PostResult{ChannelID: msg.Recipient.Address}
+
+	collection, err := n.app.FindCollectionByNameOrId(InAppCollection)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("user", msg.Recipient.Address)
+	record.Set("title", msg.Subject())
+	record.Set("message", msg.Body)
+	record.Set("task", msg.TaskID)
+	record.Set("read", false)
+
+	if err := n.app.Save(record); err != nil {
+		result.Error = err.Error()
+		result.Retryable = true
+		return result
+	}
+
+	result.MessageID = record.Id
+
+	return result
+}
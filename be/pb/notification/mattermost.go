@@ -4,17 +4,22 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/core"
 )
 
 // MattermostPost represents the structure for posting a message to Mattermost
 type MattermostPost struct {
-	ChannelID string   `json:"channel_id"`
-	Message   string   `json:"message"`
-	UserIDs   []string `json:"user_ids,omitempty"` // Optional field for user mentions
+	ChannelID string         `json:"channel_id"`
+	Message   string         `json:"message"`
+	UserIDs   []string       `json:"user_ids,omitempty"` // Optional field for user mentions
+	RootID    string         `json:"root_id,omitempty"`
+	Props     map[string]any `json:"props,omitempty"`
 }
 
 // MattermostResponse represents the response from Mattermost API
@@ -33,6 +38,7 @@ type MattermostResponse struct {
 	Type       string `json:"type"`
 	Props      struct {
 		FromWebhook string `json:"from_webhook"`
+		FeedbackID  string `json:"feedback_id"` // posted from a feedback as its sender
 	} `json:"props"`
 	Hashtags string `json:"hashtags"`
 	Filename []struct {
@@ -49,17 +55,32 @@ type MattermostError struct {
 	IsOAuth     bool   `json:"is_oauth"`
 }
 
-// PostMessageToMattermost sends a message to one or more Mattermost channels with optional user mentions
+// PostResult is the outcome of posting a message to a single channel
+type PostResult struct {
+	ChannelID  string              `json:"channel_id"`
+	MessageID  string              `json:"message_id,omitempty"`
+	StatusCode int                 `json:"status_code,omitempty"`
+	Error      string              `json:"error,omitempty"`
+	Retryable  bool                `json:"retryable"`
+	Recipients []Recipient         `json:"recipients,omitempty"`
+	Response   *MattermostResponse `json:"-"`
+}
+
+// OK reports whether the message was posted
+func (r *PostResult) OK() bool {
+	return r.Error == ""
+}
+
+// PostMessageToMattermost sends a message to one or more Mattermost channels.
+// Every channel is attempted, a failure on one channel doesn't stop the others.
 // Parameters:
 //   - channelIDs: IDs of the channels to post to
 //   - message: Message content
-//   - usernames: List of usernames to mention in the message (e.g., ["@user1", "@user2"])
 //
 // Returns:
-//   - []*MattermostResponse: Responses from Mattermost API for each channel
-//   - error: Any error encountered during the request
-func PostMessageToMattermost(channelIDs []string, message string) ([]*MattermostResponse, error) {
-	var responses []*MattermostResponse
+//   - []*PostResult: One result per channel, in the same order as channelIDs
+//   - error: Only returned when the message itself is invalid
+func PostMessageToMattermost(channelIDs []string, message string) ([]*PostResult, error) {
 	if message == "" {
 		return nil, fmt.Errorf("message cannot be empty")
 	}
@@ -67,63 +88,224 @@ func PostMessageToMattermost(channelIDs []string, message string) ([]*Mattermost
 	// Construct the message with mentions
 	finalMessage := fmt.Sprintf("%s%s", "@here ", message)
 
-	// Post to each channel
+	results := make([]*PostResult, 0, len(channelIDs))
 	for _, channelID := range channelIDs {
-		// Create the request body
-		postData := MattermostPost{
-			ChannelID: channelID,
-			Message:   finalMessage,
-		}
+		results = append(results, postToChannel(os.Getenv("MATTERMOST_BOT_TOKEN"), channelID, finalMessage, "", nil))
+	}
 
-		// Convert to JSON
-		jsonData, err := json.Marshal(postData)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal request data: %w", err)
-		}
+	return results, nil
+}
 
-		// Create HTTP request
-		apiUrl := fmt.Sprintf("%s%s", os.Getenv("MATTERMOST_SERVER_URL"), "/api/v4/posts")
-		req, err := http.NewRequest("POST", apiUrl, bytes.NewBuffer(jsonData))
-		if err != nil {
-			return nil, fmt.Errorf("failed to create HTTP request: %w", err)
-		}
+// MattermostNotifier posts notifications to Mattermost channels as the bot.
+// Feedback thread replies are posted as their sender with the access token from
+// UserToken, when set and the sender has one.
+type MattermostNotifier struct {
+	UserToken func(userId string) (string, error)
+}
 
-		// Set headers
-		botToken := os.Getenv("MATTERMOST_BOT_TOKEN")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", botToken))
-		req.Header.Set("Content-Type", "application/json")
+func (MattermostNotifier) Name() string {
+	return NotifierMattermost
+}
 
-		// Send request
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("failed to send HTTP request: %w", err)
-		}
-		defer resp.Body.Close()
+// Send posts to the recipient channel. @here is only added for department
+// channels, a direct message to a user or a thread reply doesn't need it.
+// New-task posts get the task action buttons, per task on a consolidated post.
+func (n MattermostNotifier) Send(msg Message) *PostResult {
+	if msg.Body == "" {
+		return &PostResult{ChannelID: msg.Recipient.Address, Error: "message cannot be empty"}
+	}
+
+	message := msg.Body
+	if msg.Recipient.Type != RecipientUser && msg.RootID == "" {
+		message = fmt.Sprintf("%s%s", "@here ", msg.Body)
+	}
+
+	var props map[string]any
+	if msg.Event == EventTaskCreated && msg.TaskID != "" {
+		props = TaskActionProps(msg.TaskID, "", msg.Recipient.Address)
+	} else if msg.Event == TemplateTaskCreatedBulk && len(msg.Tasks) > 0 {
+		props = BulkTaskActionProps(msg.Tasks, msg.Recipient.Address)
+	}
+
+	if msg.FeedbackID != "" {
+		// not imported back by the thread reply webhook
+		props = map[string]any{"feedback_id": msg.FeedbackID}
 
-		// Check response status
-		if resp.StatusCode != http.StatusCreated {
-			var errorResponse MattermostError
-			if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
-				return nil, fmt.Errorf("request failed with status %d, failed to decode error response: %w", resp.StatusCode, err)
+		if msg.SenderID != "" && n.UserToken != nil {
+			if token, err := n.UserToken(msg.SenderID); err == nil {
+				result := postToChannel(token, msg.Recipient.Address, message, msg.RootID, props)
+				// the sender can't post there, the bot does
+				if result.OK() || result.Retryable {
+					return result
+				}
+				log.Printf("Mattermost: failed to post feedback %s as user %s, falling back to the bot: %s", msg.FeedbackID, msg.SenderID, result.Error)
 			}
-			return nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, errorResponse.Message)
 		}
+	}
+
+	return postToChannel(os.Getenv("MATTERMOST_BOT_TOKEN"), msg.Recipient.Address, message, msg.RootID, props)
+}
+
+func postToChannel(token string, channelID string, message string, rootID string, props map[string]any) *PostResult {
+	result := &PostResult{ChannelID: channelID}
+
+	// Create the request body
+	postData := MattermostPost{
+		ChannelID: channelID,
+		Message:   message,
+		RootID:    rootID,
+		Props:     props,
+	}
+
+	// Convert to JSON
+	jsonData, err := json.Marshal(postData)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to marshal request data: %v", err)
+		return result
+	}
+
+	// Create HTTP request
+	apiUrl := fmt.Sprintf("%s%s", os.Getenv("MATTERMOST_SERVER_URL"), "/api/v4/posts")
+	req, err := http.NewRequest("POST", apiUrl, bytes.NewBuffer(jsonData))
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create HTTP request: %v", err)
+		return result
+	}
+
+	// Set headers
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("Content-Type", "application/json")
+
+	// Send request
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		// network errors and timeouts are worth another try
+		result.Error = fmt.Sprintf("failed to send HTTP request: %v", err)
+		result.Retryable = true
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+
+	// Check response status
+	if resp.StatusCode != http.StatusCreated {
+		result.Retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+
+		var errorResponse MattermostError
+		if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
+			result.Error = fmt.Sprintf("request failed with status %d, failed to decode error response: %v", resp.StatusCode, err)
+			return result
+		}
+		result.Error = fmt.Sprintf("request failed with status %d: %s", resp.StatusCode, errorResponse.Message)
+		return result
+	}
+
+	// Decode successful response
+	var response MattermostResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		// the post was created, retrying would duplicate it
+		result.Error = fmt.Sprintf("failed to decode response: %v", err)
+		return result
+	}
+
+	result.MessageID = response.ID
+	result.Response = &response
 
-		// Decode successful response
-		var response MattermostResponse
-		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-			return nil, fmt.Errorf("failed to decode response: %w", err)
+	return result
+}
+
+// GetMattermostPost fetches a post as the bot
+func GetMattermostPost(postID string) (*MattermostResponse, error) {
+	apiUrl := fmt.Sprintf("%s/api/v4/posts/%s", os.Getenv("MATTERMOST_SERVER_URL"), postID)
+	req, err := http.NewRequest("GET", apiUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("MATTERMOST_BOT_TOKEN")))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+
+	var post MattermostResponse
+	if err := json.NewDecoder(resp.Body).Decode(&post); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return &post, nil
+}
+
+// Find the users and departments linked to a channel
+func channelRecipients(app core.App, channelID string) []Recipient {
+	recipients := []Recipient{}
+
+	users, _ := app.FindAllRecords("users", dbx.HashExp{"mm_channel": channelID})
+	for _, user := range users {
+		recipients = append(recipients, Recipient{Type: RecipientUser, ID: user.Id, Notifier: NotifierMattermost, Address: channelID})
+	}
+
+	departments, _ := app.FindAllRecords("departments", dbx.HashExp{"mattermost_channel": channelID})
+	for _, dept := range departments {
+		recipients = append(recipients, Recipient{Type: RecipientDepartment, ID: dept.Id, Notifier: NotifierMattermost, Address: channelID})
+	}
+
+	return recipients
+}
+
+// Audit log of the posts made through HandleMattermostPost
+const PostAuditCollection = "mattermost_post_audit"
+
+// Record a post request with its outcome, a failure to record is only logged
+func auditPost(c *core.RequestEvent, channelIDs []string, message string, status string, sent []*PostResult, failed []*PostResult, errorMessage string) {
+	collection, err := c.App.FindCollectionByNameOrId(PostAuditCollection)
+	if err != nil {
+		log.Printf("Failed to audit Mattermost post: %v", err)
+		return
+	}
+
+	channels := func(results []*PostResult) []string {
+		ids := []string{}
+		for _, result := range results {
+			ids = append(ids, result.ChannelID)
 		}
+		return ids
+	}
 
-		responses = append(responses, &response)
+	record := core.NewRecord(collection)
+	if c.Auth != nil {
+		if c.Auth.IsSuperuser() {
+			record.Set("actor", c.Auth.Email())
+		} else {
+			record.Set("user", c.Auth.Id)
+			record.Set("actor", c.Auth.GetString("username"))
+		}
 	}
+	record.Set("channel_ids", channelIDs)
+	record.Set("message", message)
+	record.Set("status", status)
+	record.Set("sent", channels(sent))
+	record.Set("failed", channels(failed))
+	record.Set("error", errorMessage)
+	record.Set("ip", c.RealIP())
+	record.Set("user_agent", c.Request.UserAgent())
 
-	return responses, nil
+	if err := c.App.Save(record); err != nil {
+		log.Printf("Failed to audit Mattermost post: %v", err)
+	}
 }
 
-// Handle Mattermost post request
-func HandleMattermostPost(c *core.RequestEvent) error {
+// Handle Mattermost post request. canPost reports whether the caller may
+// post to a channel, every post is recorded in the audit log.
+func HandleMattermostPost(c *core.RequestEvent, canPost func(channelID string) bool) error {
 	var requestBody struct {
 		ChannelIDs []string `json:"channel_ids"`
 		Message    string   `json:"message"`
@@ -144,33 +326,81 @@ func HandleMattermostPost(c *core.RequestEvent) error {
 		})
 	}
 
+	// Only the channels the caller is linked to
+	forbidden := []string{}
+	for _, channelID := range requestBody.ChannelIDs {
+		if !canPost(channelID) {
+			forbidden = append(forbidden, channelID)
+		}
+	}
+	if len(forbidden) > 0 {
+		auditPost(c, requestBody.ChannelIDs, requestBody.Message, "rejected", nil, nil, "not linked to the channels")
+		return c.JSON(403, map[string]any{
+			"error":    "Not allowed to post to these channels",
+			"channels": forbidden,
+		})
+	}
+
 	// Call the Mattermost notification function
-	responses, err := PostMessageToMattermost(
+	results, err := PostMessageToMattermost(
 		requestBody.ChannelIDs,
 		requestBody.Message,
 	)
 
 	if err != nil {
-		return c.JSON(500, map[string]string{
+		auditPost(c, requestBody.ChannelIDs, requestBody.Message, "rejected", nil, nil, err.Error())
+		return c.JSON(400, map[string]string{
 			"error":   "Failed to post message to Mattermost",
 			"details": err.Error(),
 		})
 	}
 
-	// Prepare response data
-	var responseData []map[string]string
-	for _, response := range responses {
+	// Split results into posted and failed channels
+	sent := []*PostResult{}
+	failed := []*PostResult{}
+	for _, result := range results {
+		result.Recipients = channelRecipients(c.App, result.ChannelID)
+
+		if result.OK() {
+			sent = append(sent, result)
+		} else {
+			failed = append(failed, result)
+		}
+	}
+
+	status := 200
+	auditStatus := "sent"
+	message := "Message posted successfully to Mattermost"
+	if len(sent) == 0 {
+		status = 502
+		auditStatus = "failed"
+		message = "Failed to post message to Mattermost"
+	} else if len(failed) > 0 {
+		status = 207
+		auditStatus = "partial"
+		message = "Message posted to some of the Mattermost channels"
+	}
+
+	auditPost(c, requestBody.ChannelIDs, requestBody.Message, auditStatus, sent, failed, "")
+
+	// data keeps the posts in the shape returned before the per-channel results
+	responseData := []map[string]string{}
+	for _, result := range sent {
+		if result.Response == nil {
+			continue
+		}
 		responseData = append(responseData, map[string]string{
-			"message_id": response.ID,
-			"channel_id": response.ChannelID,
-			"created_at": fmt.Sprintf("%d", response.CreateAt),
+			"message_id": result.Response.ID,
+			"channel_id": result.Response.ChannelID,
+			"created_at": fmt.Sprintf("%d", result.Response.CreateAt),
 		})
 	}
 
-	// Return success response
-	return c.JSON(200, map[string]interface{}{
-		"success": true,
-		"message": "Message posted successfully to Mattermost",
+	return c.JSON(status, map[string]interface{}{
+		"success": len(failed) == 0,
+		"message": message,
 		"data":    responseData,
+		"sent":    sent,
+		"failed":  failed,
 	})
 }
@@ -0,0 +1,61 @@
+package notification
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPostToChannelRetryable(t *testing.T) {
+	cases := map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusForbidden:           false,
+		http.StatusNotFound:            false,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+	}
+
+	for status, retryable := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"message":"failed"}`))
+		}))
+		t.Setenv("MATTERMOST_SERVER_URL", server.URL)
+
+		result := postToChannel("token", "channel", "hello", "", nil)
+		server.Close()
+
+		if result.OK() {
+			t.Errorf("status %d: expected an error", status)
+		}
+		if result.Retryable != retryable {
+			t.Errorf("status %d: retryable = %v, want %v", status, result.Retryable, retryable)
+		}
+	}
+}
+
+func TestPostToChannelNetworkErrorRetryable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+	t.Setenv("MATTERMOST_SERVER_URL", server.URL)
+
+	result := postToChannel("token", "channel", "hello", "", nil)
+	if result.OK() || !result.Retryable {
+		t.Fatalf("expected a retryable error, got %+v", result)
+	}
+}
+
+func TestPostToChannelCreated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"post1","channel_id":"channel"}`))
+	}))
+	defer server.Close()
+	t.Setenv("MATTERMOST_SERVER_URL", server.URL)
+
+	result := postToChannel("token", "channel", "hello", "", nil)
+	if !result.OK() || result.MessageID != "post1" {
+		t.Fatalf("expected the post to succeed, got %+v", result)
+	}
+}
@@ -0,0 +1,135 @@
+package notification
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Notifier names, also used as values of the users/departments "notify_via" field
+const (
+	NotifierMattermost = "mattermost"
+	NotifierEmail      = "email"
+	NotifierWebhook    = "webhook"
+	NotifierInApp      = "inapp"
+)
+
+// Recipient types
+const (
+	RecipientUser       = "user"
+	RecipientDepartment = "department"
+	RecipientChannel    = "channel"
+)
+
+// Recipient is the user or department an address is notified on behalf of
+type Recipient struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Notifier string `json:"notifier"`
+	Address  string `json:"address"`
+	// Delivery is held back until then (quiet hours), zero means right away
+	NotBefore time.Time `json:"-"`
+	// Locale of the message, the default locale when empty
+	Locale string `json:"-"`
+}
+
+// Message is a single notification addressed to one recipient
+type Message struct {
+	Recipient Recipient
+	// Markdown formatted, the first line is used as subject where a notifier needs one
+	Body   string
+	TaskID string
+	// Event the message is about, empty for free-form messages
+	Event string
+	// Mattermost post the message replies to, empty for a new post
+	RootID string
+	// Tasks of a consolidated message, with their buttons
+	Tasks []ActionTask
+	// Feedback of a thread reply, posted as its sender when possible
+	FeedbackID string
+	SenderID   string
+}
+
+// Subject returns the first line of the message without markdown emphasis
+func (m Message) Subject() string {
+	subject, _, _ := strings.Cut(m.Body, "\n")
+	return strings.TrimSpace(strings.ReplaceAll(subject, "**", ""))
+}
+
+// Notifier delivers messages over one transport (Mattermost, email, ...)
+type Notifier interface {
+	Name() string
+	// Send delivers the message to msg.Recipient.Address.
+	// The returned result tells whether a failed delivery is worth retrying.
+	Send(msg Message) *PostResult
+}
+
+// Resolve how a user wants to be notified from their "notify_via" field.
+// When nothing is set, users with a Mattermost channel get Mattermost,
+// everyone else gets email and in-app notifications.
+func UserRecipients(user *core.Record) []Recipient {
+	via := user.GetStringSlice("notify_via")
+	if len(via) == 0 {
+		if user.GetString("mm_channel") != "" {
+			via = []string{NotifierMattermost}
+		} else {
+			via = []string{NotifierEmail, NotifierInApp}
+		}
+	}
+
+	recipients := []Recipient{}
+	for _, notifier := range via {
+		recipients = append(recipients, userRecipient(user, notifier)...)
+	}
+
+	return recipients
+}
+
+// Address the user over a single notifier, nothing when the user has no address for it
+func userRecipient(user *core.Record, notifier string) []Recipient {
+	address := ""
+	switch notifier {
+	case NotifierMattermost:
+		address = user.GetString("mm_channel")
+	case NotifierEmail:
+		address = user.GetString("email")
+	case NotifierWebhook:
+		address = user.GetString("webhook_url")
+	case NotifierInApp:
+		address = user.Id
+	}
+	if address == "" {
+		return nil
+	}
+
+	return []Recipient{{Type: RecipientUser, ID: user.Id, Notifier: notifier, Address: address, Locale: user.GetString("locale")}}
+}
+
+// Resolve how a department wants to be notified from its "notify_via" field,
+// defaulting to its Mattermost channel.
+func DepartmentRecipients(dept *core.Record) []Recipient {
+	via := dept.GetStringSlice("notify_via")
+	if len(via) == 0 {
+		via = []string{NotifierMattermost}
+	}
+
+	recipients := []Recipient{}
+	for _, notifier := range via {
+		address := ""
+		switch notifier {
+		case NotifierMattermost:
+			address = dept.GetString("mattermost_channel")
+		case NotifierEmail:
+			address = dept.GetString("email")
+		case NotifierWebhook:
+			address = dept.GetString("webhook_url")
+		}
+		if address == "" {
+			continue
+		}
+		recipients = append(recipients, Recipient{Type: RecipientDepartment, ID: dept.Id, Notifier: notifier, Address: address})
+	}
+
+	return recipients
+}
@@ -0,0 +1,436 @@
+package notification
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const OutboxCollection = "notification_outbox"
+
+// Outbox entry statuses
+const (
+	OutboxStatusPending = "pending"
+	OutboxStatusSent    = "sent"
+	OutboxStatusDead    = "dead"
+)
+
+const (
+	defaultOutboxMaxAttempts = 8
+	outboxBaseBackoff        = 30 * time.Second
+	outboxMaxBackoff         = time.Hour
+	outboxPollInterval       = 15 * time.Second
+	outboxBatchSize          = 50
+)
+
+// Outbox persists outgoing notifications and delivers them through their
+// notifier from a background worker, retrying with exponential backoff until
+// the message is sent or dead-lettered after MaxAttempts.
+type Outbox struct {
+	app         core.App
+	notifiers   map[string]Notifier
+	MaxAttempts int
+
+	wake chan struct{}
+	stop chan struct{}
+	once sync.Once
+	done sync.WaitGroup
+}
+
+// NewOutbox creates an outbox for the app delivering through the given notifiers.
+// MATTERMOST_OUTBOX_MAX_ATTEMPTS overrides the default number of attempts.
+func NewOutbox(app core.App, notifiers ...Notifier) *Outbox {
+	maxAttempts := defaultOutboxMaxAttempts
+	if v, err := strconv.Atoi(os.Getenv("MATTERMOST_OUTBOX_MAX_ATTEMPTS")); err == nil && v > 0 {
+		maxAttempts = v
+	}
+
+	byName := make(map[string]Notifier, len(notifiers))
+	for _, notifier := range notifiers {
+		byName[notifier.Name()] = notifier
+	}
+
+	return &Outbox{
+		app:         app,
+		notifiers:   byName,
+		MaxAttempts: maxAttempts,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Enqueue stores one outbox entry per recipient, so every address is retried
+// independently, and wakes the worker. taskId is optional.
+func (o *Outbox) Enqueue(recipients []Recipient, message string, taskId string) error {
+	return o.enqueue(recipients, outboxEntry{Message: message, TaskID: taskId})
+}
+
+// EnqueueReply queues a Mattermost thread reply under the rootId post of the channel
+func (o *Outbox) EnqueueReply(channelId string, rootId string, message string, taskId string) error {
+	recipient := Recipient{Type: RecipientChannel, ID: channelId, Notifier: NotifierMattermost, Address: channelId}
+	return o.enqueue([]Recipient{recipient}, outboxEntry{RootID: rootId, Message: message, TaskID: taskId})
+}
+
+// EnqueueFeedbackReply queues the thread reply of a feedback, posted as its
+// sender when they have a Mattermost token, else as the bot
+func (o *Outbox) EnqueueFeedbackReply(channelId string, rootId string, message string, taskId string, feedbackId string, senderId string) error {
+	recipient := Recipient{Type: RecipientChannel, ID: channelId, Notifier: NotifierMattermost, Address: channelId}
+	return o.enqueue([]Recipient{recipient}, outboxEntry{
+		RootID:     rootId,
+		Message:    message,
+		TaskID:     taskId,
+		FeedbackID: feedbackId,
+		SenderID:   senderId,
+	})
+}
+
+// Outbox entry besides its recipient
+type outboxEntry struct {
+	// event the message is about, lets notifiers adapt the message (eg. task action buttons)
+	Event string
+	// makes a Mattermost message a thread reply
+	RootID  string
+	Message string
+	TaskID  string
+	// tasks of a consolidated message
+	TaskIDs []string
+	// feedback posted as a thread reply by its sender
+	FeedbackID string
+	SenderID   string
+}
+
+// Store one outbox entry per recipient and wake the worker
+func (o *Outbox) enqueue(recipients []Recipient, entry outboxEntry) error {
+	if entry.Message == "" {
+		return fmt.Errorf("message cannot be empty")
+	}
+
+	collection, err := o.app.FindCollectionByNameOrId(OutboxCollection)
+	if err != nil {
+		return err
+	}
+
+	for _, recipient := range recipients {
+		record := core.NewRecord(collection)
+		record.Set("notifier", recipient.Notifier)
+		record.Set("address", recipient.Address)
+		record.Set("recipient_type", recipient.Type)
+		record.Set("recipient_id", recipient.ID)
+		record.Set("message", entry.Message)
+		record.Set("status", OutboxStatusPending)
+		record.Set("attempts", 0)
+		record.Set("next_attempt_at", types.NowDateTime())
+		if !recipient.NotBefore.IsZero() {
+			record.Set("next_attempt_at", recipient.NotBefore)
+		}
+		record.Set("task", entry.TaskID)
+		record.Set("tasks", entry.TaskIDs)
+		record.Set("event", entry.Event)
+		record.Set("root_id", entry.RootID)
+		record.Set("feedback", entry.FeedbackID)
+		record.Set("sender", entry.SenderID)
+
+		if err := o.app.Save(record); err != nil {
+			return fmt.Errorf("failed to enqueue %s message for %s: %w", recipient.Notifier, recipient.Address, err)
+		}
+	}
+
+	o.Wake()
+
+	return nil
+}
+
+// Wake asks the worker to process due entries without waiting for the next poll.
+func (o *Outbox) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the delivery worker in the background until Stop is called.
+func (o *Outbox) Start() {
+	o.done.Add(1)
+	go func() {
+		defer o.done.Done()
+
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+
+		for {
+			o.processDue()
+
+			select {
+			case <-o.stop:
+				return
+			case <-ticker.C:
+			case <-o.wake:
+			}
+		}
+	}()
+}
+
+// Stop stops the worker and waits for the current batch to finish.
+func (o *Outbox) Stop() {
+	o.once.Do(func() {
+		close(o.stop)
+	})
+	o.done.Wait()
+}
+
+func (o *Outbox) processDue() {
+	records, err := o.app.FindRecordsByFilter(
+		OutboxCollection,
+		"status = {:status} && next_attempt_at <= {:now}",
+		"next_attempt_at",
+		outboxBatchSize,
+		0,
+		dbx.Params{"status": OutboxStatusPending, "now": types.NowDateTime().String()},
+	)
+	if err != nil {
+		log.Printf("Outbox: failed to load pending messages: %v", err)
+		return
+	}
+
+	for _, record := range records {
+		o.deliver(record)
+	}
+}
+
+func (o *Outbox) deliver(record *core.Record) {
+	attempts := record.GetInt("attempts") + 1
+	record.Set("attempts", attempts)
+
+	msg := Message{
+		Recipient: Recipient{
+			Type:     record.GetString("recipient_type"),
+			ID:       record.GetString("recipient_id"),
+			Notifier: record.GetString("notifier"),
+			Address:  record.GetString("address"),
+		},
+		Body:   record.GetString("message"),
+		TaskID: record.GetString("task"),
+		Event:  record.GetString("event"),
+		RootID: record.GetString("root_id"),
+		Tasks:  LoadActionTasks(o.app, record.GetStringSlice("tasks")),
+
+		FeedbackID: record.GetString("feedback"),
+		SenderID:   record.GetString("sender"),
+	}
+
+	var result *PostResult
+	if notifier, ok := o.notifiers[msg.Recipient.Notifier]; ok {
+		result = notifier.Send(msg)
+	} else {
+		result = &PostResult{ChannelID: msg.Recipient.Address, Error: fmt.Sprintf("unknown notifier %q", msg.Recipient.Notifier)}
+	}
+
+	record.Set("last_status", result.StatusCode)
+
+	if result.OK() {
+		record.Set("status", OutboxStatusSent)
+		record.Set("last_error", "")
+		record.Set("post_id", result.MessageID)
+		o.linkTaskThread(record, result)
+		o.linkFeedbackPost(record, result)
+	} else {
+		record.Set("last_error", result.Error)
+		if !result.Retryable || attempts >= o.MaxAttempts {
+			record.Set("status", OutboxStatusDead)
+			log.Printf("Outbox: message %s for %s %s dead-lettered after %d attempts: %s",
+				record.Id, record.GetString("recipient_type"), record.GetString("recipient_id"), attempts, result.Error)
+		} else {
+			record.Set("next_attempt_at", time.Now().Add(outboxBackoff(attempts)))
+		}
+	}
+
+	if err := o.app.Save(record); err != nil {
+		log.Printf("Outbox: failed to save message %s: %v", record.Id, err)
+	}
+}
+
+// LoadActionTasks loads the tasks of a consolidated message in their order, with
+// their current status for the buttons
+func LoadActionTasks(app core.App, taskIds []string) []ActionTask {
+	if len(taskIds) == 0 {
+		return nil
+	}
+	if len(taskIds) > bulkActionTaskLimit {
+		taskIds = taskIds[:bulkActionTaskLimit]
+	}
+
+	records, err := app.FindRecordsByIds("tasks", taskIds)
+	if err != nil {
+		log.Printf("Outbox: failed to load tasks %v: %v", taskIds, err)
+		return nil
+	}
+
+	byId := make(map[string]*core.Record, len(records))
+	for _, record := range records {
+		byId[record.Id] = record
+	}
+
+	tasks := make([]ActionTask, 0, len(records))
+	for _, id := range taskIds {
+		if record, ok := byId[id]; ok {
+			tasks = append(tasks, ActionTask{ID: id, Title: record.GetString("title"), Status: record.GetString("status")})
+		}
+	}
+
+	return tasks
+}
+
+// outboxBackoff returns the delay before the next attempt: 30s, 1m, 2m, ... capped at 1h.
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxBaseBackoff
+	for i := 1; i < attempts && delay < outboxMaxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, outboxMaxBackoff)
+}
+
+// HandleOutboxList lists outbox entries, dead-lettered ones by default
+func (o *Outbox) HandleOutboxList(c *core.RequestEvent) error {
+	status := c.Request.URL.Query().Get("status")
+	if status == "" {
+		status = OutboxStatusDead
+	}
+
+	records, err := o.app.FindRecordsByFilter(
+		OutboxCollection,
+		"status = {:status}",
+		"-updated",
+		200,
+		0,
+		dbx.Params{"status": status},
+	)
+	if err != nil {
+		return c.JSON(500, map[string]string{
+			"error": "Failed to load outbox",
+		})
+	}
+
+	return c.JSON(200, map[string]interface{}{
+		"success": true,
+		"data":    records,
+	})
+}
+
+// HandleOutboxRetry re-drives the given dead-lettered entries, or all of them when no ids are sent
+func (o *Outbox) HandleOutboxRetry(c *core.RequestEvent) error {
+	var requestBody struct {
+		IDs []string `json:"ids"`
+	}
+
+	if err := c.BindBody(&requestBody); err != nil {
+		return c.JSON(400, map[string]string{
+			"error": "Invalid request body",
+		})
+	}
+
+	var records []*core.Record
+	var err error
+	if len(requestBody.IDs) > 0 {
+		records, err = o.app.FindRecordsByIds(OutboxCollection, requestBody.IDs)
+	} else {
+		records, err = o.app.FindAllRecords(OutboxCollection, dbx.HashExp{"status": OutboxStatusDead})
+	}
+	if err != nil {
+		return c.JSON(500, map[string]string{
+			"error": "Failed to load outbox",
+		})
+	}
+
+	retried := []string{}
+	for _, record := range records {
+		if record.GetString("status") != OutboxStatusDead {
+			continue
+		}
+
+		record.Set("status", OutboxStatusPending)
+		record.Set("attempts", 0)
+		record.Set("next_attempt_at", types.NowDateTime())
+
+		if err := o.app.Save(record); err != nil {
+			return c.JSON(500, map[string]string{
+				"error":   "Failed to re-queue message",
+				"details": err.Error(),
+			})
+		}
+		retried = append(retried, record.Id)
+	}
+
+	o.Wake()
+
+	return c.JSON(200, map[string]interface{}{
+		"success": true,
+		"retried": retried,
+	})
+}
+
+// Store the Mattermost announcement of a new task on the task, feedbacks are threaded under it.
+// The department channel post is used, or the first direct message when the task has no department.
+// The tasks created in bulk share the consolidated post.
+func (o *Outbox) linkTaskThread(record *core.Record, result *PostResult) {
+	if record.GetString("notifier") != NotifierMattermost || result.MessageID == "" {
+		return
+	}
+
+	var taskIds []string
+	switch record.GetString("event") {
+	case EventTaskCreated:
+		taskIds = []string{record.GetString("task")}
+	case TemplateTaskCreatedBulk:
+		taskIds = record.GetStringSlice("tasks")
+	default:
+		return
+	}
+
+	tasks, err := o.app.FindRecordsByIds("tasks", taskIds)
+	if err != nil {
+		return
+	}
+
+	for _, task := range tasks {
+		if task.GetString("mm_post_id") != "" {
+			continue
+		}
+		if record.GetString("recipient_type") != RecipientDepartment && len(task.GetStringSlice("departments")) > 0 {
+			continue
+		}
+
+		task.Set("mm_post_id", result.MessageID)
+		task.Set("mm_channel_id", result.ChannelID)
+
+		if err := o.app.Save(task); err != nil {
+			log.Printf("Outbox: failed to link task %s to post %s: %v", task.Id, result.MessageID, err)
+		}
+	}
+}
+
+// Store the Mattermost post of a feedback thread reply on the feedback, the thread
+// reply webhook doesn't import it back
+func (o *Outbox) linkFeedbackPost(record *core.Record, result *PostResult) {
+	if record.GetString("feedback") == "" || result.MessageID == "" {
+		return
+	}
+
+	feedback, err := o.app.FindRecordById("feedbacks", record.GetString("feedback"))
+	if err != nil || feedback.GetString("mm_post_id") != "" {
+		return
+	}
+
+	feedback.Set("mm_post_id", result.MessageID)
+
+	if err := o.app.Save(feedback); err != nil {
+		log.Printf("Outbox: failed to link feedback %s to post %s: %v", feedback.Id, result.MessageID, err)
+	}
+}
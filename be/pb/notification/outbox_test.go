@@ -0,0 +1,24 @@
+package notification
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		0:   30 * time.Second,
+		1:   30 * time.Second,
+		2:   time.Minute,
+		3:   2 * time.Minute,
+		4:   4 * time.Minute,
+		8:   time.Hour,
+		100: time.Hour,
+	}
+
+	for attempts, want := range cases {
+		if got := outboxBackoff(attempts); got != want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
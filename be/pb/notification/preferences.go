@@ -0,0 +1,311 @@
+package notification
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const PreferencesCollection = "notification_preferences"
+
+// Event types users can opt in or out of
+const (
+	EventTaskCreated    = "task_created"
+	EventTaskAssigned   = "task_assigned"
+	EventTaskUnassigned = "task_unassigned"
+	EventTaskStatus     = "task_status"
+	EventTaskDueChanged = "task_due_changed"
+	EventTaskReminder   = "task_reminder"
+	EventTaskOverdue    = "task_overdue"
+	// an assignee was deactivated on Mattermost and removed from the task
+	EventTaskAssigneeDeactivated = "task_assignee_deactivated"
+)
+
+var Events = []string{
+	EventTaskCreated,
+	EventTaskAssigned,
+	EventTaskUnassigned,
+	EventTaskStatus,
+	EventTaskDueChanged,
+	EventTaskReminder,
+	EventTaskOverdue,
+	EventTaskAssigneeDeactivated,
+}
+
+// Notifiers users can pick as their channels
+var Channels = []string{NotifierMattermost, NotifierEmail, NotifierWebhook, NotifierInApp}
+
+// Delivery modes
+const (
+	DeliveryImmediate = "immediate"
+	DeliveryDigest    = "digest"
+)
+
+var deliveryModes = []string{DeliveryImmediate, DeliveryDigest}
+
+// Digest frequencies
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+	DigestOff    = "off"
+)
+
+var digestFrequencies = []string{DigestDaily, DigestWeekly, DigestOff}
+
+// Preferences of a user, the users without stored preferences get the defaults:
+// every event, immediate delivery, daily digest, no quiet hours.
+// Stored preferences without events opt out of all of them.
+type Preferences struct {
+	UserID     string   `json:"user"`
+	Events     []string `json:"events"`
+	Channels   []string `json:"channels"`
+	Delivery   string   `json:"delivery"`
+	Digest     string   `json:"digest"`
+	QuietStart string   `json:"quiet_start"`
+	QuietEnd   string   `json:"quiet_end"`
+	Timezone   string   `json:"timezone"`
+}
+
+// LoadPreferences returns the preferences of the user, or the defaults when none are stored
+func LoadPreferences(app core.App, user *core.Record) *Preferences {
+	prefs := &Preferences{
+		UserID:   user.Id,
+		Events:   slices.Clone(Events),
+		Channels: []string{},
+		Delivery: DeliveryImmediate,
+		Digest:   DigestDaily,
+		Timezone: user.GetString("timezone"),
+	}
+
+	record, err := app.FindFirstRecordByFilter(PreferencesCollection, "user = {:user}", dbx.Params{"user": user.Id})
+	if err != nil {
+		return prefs
+	}
+
+	prefs.Events = record.GetStringSlice("events")
+	prefs.Channels = record.GetStringSlice("channels")
+	if delivery := record.GetString("delivery"); delivery != "" {
+		prefs.Delivery = delivery
+	}
+	if digest := record.GetString("digest"); digest != "" {
+		prefs.Digest = digest
+	}
+	prefs.QuietStart = record.GetString("quiet_start")
+	prefs.QuietEnd = record.GetString("quiet_end")
+
+	return prefs
+}
+
+// Wants reports whether the user wants immediate notifications for the event
+func (p *Preferences) Wants(event string) bool {
+	if p.Delivery == DeliveryDigest {
+		return false
+	}
+
+	return slices.Contains(p.Events, event)
+}
+
+// Location returns the user's Mattermost timezone, the server timezone when unknown
+func (p *Preferences) Location() *time.Location {
+	return TimezoneLocation(p.Timezone)
+}
+
+// TimezoneLocation returns the location of an IANA timezone name, the server timezone when unknown
+func TimezoneLocation(name string) *time.Location {
+	if name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// QuietUntil returns the end of the quiet hours the time falls in,
+// or the zero time when notifications can be sent right away.
+func (p *Preferences) QuietUntil(t time.Time) time.Time {
+	start, errStart := parseClock(p.QuietStart)
+	end, errEnd := parseClock(p.QuietEnd)
+	if errStart != nil || errEnd != nil || start == end {
+		return time.Time{}
+	}
+
+	local := t.In(p.Location())
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	now := local.Sub(midnight)
+
+	if start < end {
+		// eg. 12:00 - 13:30
+		if now >= start && now < end {
+			return midnight.Add(end)
+		}
+		return time.Time{}
+	}
+
+	// overnight, eg. 22:00 - 07:00
+	if now >= start {
+		return midnight.AddDate(0, 0, 1).Add(end)
+	}
+	if now < end {
+		return midnight.Add(end)
+	}
+	return time.Time{}
+}
+
+// Parse a "HH:MM" clock time into the duration since midnight
+func parseClock(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, fmt.Errorf("empty clock time")
+	}
+
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ResolveUser returns the addresses to notify the user of the event on,
+// honoring their preferences. Quiet hours delay the delivery through NotBefore.
+// wanted is false when the user opted out of the event.
+func ResolveUser(app core.App, user *core.Record, event string) (recipients []Recipient, wanted bool) {
+	prefs := LoadPreferences(app, user)
+	if !prefs.Wants(event) {
+		return nil, false
+	}
+
+	recipients = UserRecipients(user)
+	if len(prefs.Channels) > 0 {
+		recipients = slices.DeleteFunc(recipients, func(r Recipient) bool {
+			return !slices.Contains(prefs.Channels, r.Notifier)
+		})
+		// the preferred channels may not be part of notify_via
+		for _, notifier := range prefs.Channels {
+			if !slices.ContainsFunc(recipients, func(r Recipient) bool { return r.Notifier == notifier }) {
+				recipients = append(recipients, userRecipient(user, notifier)...)
+			}
+		}
+	}
+
+	if until := prefs.QuietUntil(time.Now()); !until.IsZero() {
+		for i := range recipients {
+			// in-app notifications are silent anyway
+			if recipients[i].Notifier != NotifierInApp {
+				recipients[i].NotBefore = until
+			}
+		}
+	}
+
+	return recipients, true
+}
+
+// HandleGetPreferences returns the preferences of the authenticated user
+func HandleGetPreferences(c *core.RequestEvent) error {
+	prefs := LoadPreferences(c.App, c.Auth)
+
+	return c.JSON(200, map[string]any{
+		"preferences": prefs,
+		"events":      Events,
+		"channels":    Channels,
+	})
+}
+
+// First value that isn't allowed, empty when they all are
+func invalidValue(values []string, allowed []string) string {
+	for _, value := range values {
+		if !slices.Contains(allowed, value) {
+			return value
+		}
+	}
+	return ""
+}
+
+// HandleUpdatePreferences stores the preferences of the authenticated user.
+// Without events the stored ones are kept, an empty list opts out of every event.
+func HandleUpdatePreferences(c *core.RequestEvent) error {
+	var requestBody struct {
+		Events     []string `json:"events"`
+		Channels   []string `json:"channels"`
+		Delivery   string   `json:"delivery"`
+		Digest     string   `json:"digest"`
+		QuietStart string   `json:"quiet_start"`
+		QuietEnd   string   `json:"quiet_end"`
+	}
+
+	if err := c.BindBody(&requestBody); err != nil {
+		return c.JSON(400, map[string]string{
+			"error": "Invalid request body",
+		})
+	}
+
+	for _, value := range []string{requestBody.QuietStart, requestBody.QuietEnd} {
+		if _, err := parseClock(value); value != "" && err != nil {
+			return c.JSON(400, map[string]string{
+				"error": "Quiet hours must use the HH:MM format",
+			})
+		}
+	}
+
+	if requestBody.Delivery == "" {
+		requestBody.Delivery = DeliveryImmediate
+	}
+	if requestBody.Digest == "" {
+		requestBody.Digest = DigestDaily
+	}
+
+	checks := []struct {
+		name    string
+		values  []string
+		allowed []string
+	}{
+		{"event", requestBody.Events, Events},
+		{"channel", requestBody.Channels, Channels},
+		{"delivery", []string{requestBody.Delivery}, deliveryModes},
+		{"digest", []string{requestBody.Digest}, digestFrequencies},
+	}
+	for _, check := range checks {
+		if value := invalidValue(check.values, check.allowed); value != "" {
+			return c.JSON(400, map[string]string{
+				"error": fmt.Sprintf("Invalid %s %q, expected one of %v", check.name, value, check.allowed),
+			})
+		}
+	}
+
+	collection, err := c.App.FindCollectionByNameOrId(PreferencesCollection)
+	if err != nil {
+		return c.JSON(500, map[string]string{
+			"error": "notification preferences collection not found",
+		})
+	}
+
+	record, _ := c.App.FindFirstRecordByFilter(collection, "user = {:user}", dbx.Params{"user": c.Auth.Id})
+	if record == nil {
+		record = core.NewRecord(collection)
+		record.Set("user", c.Auth.Id)
+		record.Set("events", Events)
+	}
+
+	if requestBody.Events != nil {
+		record.Set("events", requestBody.Events)
+	}
+	record.Set("channels", requestBody.Channels)
+	record.Set("delivery", requestBody.Delivery)
+	record.Set("digest", requestBody.Digest)
+	record.Set("quiet_start", requestBody.QuietStart)
+	record.Set("quiet_end", requestBody.QuietEnd)
+
+	if err := c.App.Save(record); err != nil {
+		return c.JSON(400, map[string]string{
+			"error":   "Failed to save notification preferences",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(200, map[string]any{
+		"success":     true,
+		"preferences": LoadPreferences(c.App, c.Auth),
+	})
+}
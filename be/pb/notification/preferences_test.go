@@ -0,0 +1,69 @@
+package notification
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPreferencesWants(t *testing.T) {
+	prefs := &Preferences{Events: []string{EventTaskAssigned}, Delivery: DeliveryImmediate}
+
+	if !prefs.Wants(EventTaskAssigned) {
+		t.Error("expected the chosen event to be wanted")
+	}
+	if prefs.Wants(EventTaskStatus) {
+		t.Error("expected the other events not to be wanted")
+	}
+
+	prefs.Delivery = DeliveryDigest
+	if prefs.Wants(EventTaskAssigned) {
+		t.Error("expected no immediate notifications with the digest delivery")
+	}
+
+	empty := &Preferences{Events: []string{}, Delivery: DeliveryImmediate}
+	if empty.Wants(EventTaskCreated) {
+		t.Error("expected no events to opt out of all of them")
+	}
+}
+
+func TestPreferencesQuietUntil(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2026, 10, 16, hour, minute, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		name  string
+		start string
+		end   string
+		now   time.Time
+		want  time.Time
+	}{
+		{"no quiet hours", "", "", at(23, 0), time.Time{}},
+		{"same start and end", "22:00", "22:00", at(22, 0), time.Time{}},
+		{"inside daytime", "12:00", "13:30", at(12, 15), at(13, 30)},
+		{"before daytime", "12:00", "13:30", at(11, 59), time.Time{}},
+		{"at daytime end", "12:00", "13:30", at(13, 30), time.Time{}},
+		{"overnight evening", "22:00", "07:00", at(23, 0), at(7, 0).AddDate(0, 0, 1)},
+		{"overnight morning", "22:00", "07:00", at(6, 0), at(7, 0)},
+		{"outside overnight", "22:00", "07:00", at(12, 0), time.Time{}},
+		{"invalid clock", "25:00", "07:00", at(23, 0), time.Time{}},
+	}
+
+	for _, tc := range cases {
+		prefs := &Preferences{QuietStart: tc.start, QuietEnd: tc.end, Timezone: "UTC"}
+		if got := prefs.QuietUntil(tc.now); !got.Equal(tc.want) {
+			t.Errorf("%s: QuietUntil = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPreferencesQuietUntilTimezone(t *testing.T) {
+	// 16:00 UTC is 23:00 in Ho Chi Minh City (UTC+7)
+	prefs := &Preferences{QuietStart: "22:00", QuietEnd: "07:00", Timezone: "Asia/Ho_Chi_Minh"}
+
+	got := prefs.QuietUntil(time.Date(2026, 10, 16, 16, 0, 0, 0, time.UTC))
+	want := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Fatalf("QuietUntil = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,332 @@
+package notification
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const TemplatesCollection = "notification_templates"
+
+// Template and event of the consolidated message for tasks created in bulk.
+// The outbox entry lists the tasks, they share its Mattermost post.
+const TemplateTaskCreatedBulk = "task_created_bulk"
+
+// Template of the task digests of the users and departments
+const TemplateDigest = "digest"
+
+// Template of the open tasks listed by the "/task list" slash command
+const TemplateTaskList = "task_list"
+
+// Built-in templates named "<event>.<locale>.tmpl", used when no template is stored in the collection
+//
+//go:embed templates/*.tmpl
+var defaultTemplates embed.FS
+
+// DefaultLocale returns the locale used when a user's locale has no template, DEFAULT_LOCALE or "vi"
+func DefaultLocale() string {
+	if locale := os.Getenv("DEFAULT_LOCALE"); locale != "" {
+		return locale
+	}
+	return "vi"
+}
+
+// TemplateData is passed to the message templates
+type TemplateData struct {
+	ID         string
+	Title      string
+	Link       string
+	Status     string
+	OldStatus  string
+	DueDate    time.Time
+	OldDueDate time.Time
+	// Name of the user the event is about, eg. a deactivated assignee
+	User string
+	// Tasks created in bulk, Count of them in total and More left out of the list
+	Tasks []TemplateData
+	Count int
+	More  int
+	// Sections of a digest, Title is the name of the user or department
+	Sections []DigestSection
+}
+
+// DigestSection lists the tasks of a digest section (open, due_this_week, overdue, completed),
+// Count of them in total and More left out of the list
+type DigestSection struct {
+	Name  string
+	Tasks []TemplateData
+	Count int
+	More  int
+}
+
+// TaskLink returns the frontend link of a task
+func TaskLink(taskId string) string {
+	return fmt.Sprintf("%s/%s", os.Getenv("APP_URL"), taskId)
+}
+
+// TaskTemplateData builds the template data of a task, the old values come from its original state
+func TaskTemplateData(task *core.Record) TemplateData {
+	data := TemplateData{
+		ID:      task.Id,
+		Title:   task.GetString("title"),
+		Link:    TaskLink(task.Id),
+		Status:  task.GetString("status"),
+		DueDate: task.GetDateTime("due_date").Time(),
+	}
+
+	if !task.IsNew() {
+		original := task.Original()
+		data.OldStatus = original.GetString("status")
+		data.OldDueDate = original.GetDateTime("due_date").Time()
+	}
+
+	return data
+}
+
+func sampleTemplateData() TemplateData {
+	sample := TemplateData{
+		ID:         "SAMPLE",
+		Title:      "Chuẩn bị báo cáo tháng",
+		Link:       TaskLink("SAMPLE"),
+		Status:     "in_progress",
+		OldStatus:  "todo",
+		DueDate:    time.Now().Add(24 * time.Hour),
+		OldDueDate: time.Now().Add(72 * time.Hour),
+		User:       "Nguyễn Văn An",
+	}
+	sample.Tasks = []TemplateData{sample, {ID: "SAMPLE2", Title: "Kiểm kê kho", Link: TaskLink("SAMPLE2"), Status: "todo"}}
+	sample.Count = len(sample.Tasks)
+	sample.Sections = []DigestSection{{Name: "open", Tasks: sample.Tasks, Count: sample.Count}}
+
+	return sample
+}
+
+var statusLabels = map[string]map[string]string{
+	"vi": {
+		"backlog":     "Tồn đọng",
+		"todo":        "Cần làm",
+		"in_progress": "Đang thực hiện",
+		"done":        "Hoàn thành",
+		"canceled":    "Đã hủy",
+	},
+	"en": {
+		"backlog":     "Backlog",
+		"todo":        "Todo",
+		"in_progress": "In Progress",
+		"done":        "Done",
+		"canceled":    "Canceled",
+	},
+}
+
+// StatusLabel returns the label of a task status code in the locale
+func StatusLabel(status string, locale string) string {
+	if label, ok := statusLabels[baseLanguage(locale)][status]; ok {
+		return label
+	}
+	return status
+}
+
+var noDueDateLabels = map[string]string{
+	"vi": "không có hạn",
+	"en": "no due date",
+}
+
+// Template functions for a locale:
+//   - status: label of a task status code
+//   - date: due date formatted in the server timezone
+func templateFuncs(locale string) template.FuncMap {
+	lang := baseLanguage(locale)
+
+	return template.FuncMap{
+		"status": func(status string) string {
+			return StatusLabel(status, locale)
+		},
+		"date": func(t time.Time) string {
+			if t.IsZero() {
+				if label, ok := noDueDateLabels[lang]; ok {
+					return label
+				}
+				return noDueDateLabels["en"]
+			}
+			return t.In(time.Local).Format("02/01/2006 15:04")
+		},
+	}
+}
+
+// "pt-BR" -> "pt"
+func baseLanguage(locale string) string {
+	lang, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	return lang
+}
+
+// Candidate locales for a user locale, most specific first
+func localeFallbacks(locale string) []string {
+	candidates := []string{}
+	for _, candidate := range []string{strings.ToLower(locale), baseLanguage(locale), DefaultLocale()} {
+		if candidate != "" && !slices.Contains(candidates, candidate) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// Find the template source of the event for the locale. Templates stored in the
+// collection win over the built-in ones, then the base language and the default locale are tried.
+func findTemplate(app core.App, event string, locale string) (string, string, error) {
+	for _, candidate := range localeFallbacks(locale) {
+		record, err := app.FindFirstRecordByFilter(
+			TemplatesCollection,
+			"event = {:event} && locale = {:locale}",
+			dbx.Params{"event": event, "locale": candidate},
+		)
+		if err == nil {
+			return record.GetString("body"), candidate, nil
+		}
+
+		body, err := defaultTemplates.ReadFile(fmt.Sprintf("templates/%s.%s.tmpl", event, candidate))
+		if err == nil {
+			return string(body), candidate, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("no template for event %q", event)
+}
+
+func executeTemplate(source string, locale string, data TemplateData) (string, error) {
+	tmpl, err := template.New("message").Funcs(templateFuncs(locale)).Option("missingkey=error").Parse(source)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(b.String()), nil
+}
+
+// RenderTemplate renders the message of the event in the given locale
+func RenderTemplate(app core.App, event string, locale string, data TemplateData) (string, error) {
+	source, resolved, err := findTemplate(app, event, locale)
+	if err != nil {
+		return "", err
+	}
+
+	return executeTemplate(source, resolved, data)
+}
+
+// EnqueueTemplate renders the event message in the locale of every recipient and queues it
+func (o *Outbox) EnqueueTemplate(recipients []Recipient, event string, data TemplateData, taskId string) error {
+	return o.enqueueTemplate(recipients, event, data, taskId, nil)
+}
+
+// EnqueueBulkTemplate queues the consolidated message of the tasks created in bulk
+func (o *Outbox) EnqueueBulkTemplate(recipients []Recipient, data TemplateData, taskIds []string) error {
+	return o.enqueueTemplate(recipients, TemplateTaskCreatedBulk, data, "", taskIds)
+}
+
+func (o *Outbox) enqueueTemplate(recipients []Recipient, event string, data TemplateData, taskId string, taskIds []string) error {
+	byLocale := map[string][]Recipient{}
+	for _, recipient := range recipients {
+		locale := recipient.Locale
+		if locale == "" {
+			locale = DefaultLocale()
+		}
+		byLocale[locale] = append(byLocale[locale], recipient)
+	}
+
+	for locale, group := range byLocale {
+		message, err := RenderTemplate(o.app, event, locale, data)
+		if err != nil {
+			return fmt.Errorf("failed to render %s message: %w", event, err)
+		}
+
+		if err := o.enqueue(group, outboxEntry{Event: event, Message: message, TaskID: taskId, TaskIDs: taskIds}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateTemplate rejects stored templates that don't parse or render against the sample task
+func ValidateTemplate(e *core.RecordRequestEvent) error {
+	if _, err := executeTemplate(e.Record.GetString("body"), e.Record.GetString("locale"), sampleTemplateData()); err != nil {
+		return apis.NewBadRequestError("Invalid template: "+err.Error(), nil)
+	}
+
+	return e.Next()
+}
+
+// HandleTemplatePreview renders a template against a task, or a sample task when none is given.
+// The body can be sent to preview unsaved changes, otherwise the current template is used.
+func HandleTemplatePreview(c *core.RequestEvent) error {
+	var requestBody struct {
+		Event  string `json:"event"`
+		Locale string `json:"locale"`
+		Body   string `json:"body"`
+		Task   string `json:"task"`
+	}
+
+	if err := c.BindBody(&requestBody); err != nil {
+		return c.JSON(400, map[string]string{
+			"error": "Invalid request body",
+		})
+	}
+
+	if requestBody.Event == "" {
+		return c.JSON(400, map[string]string{
+			"error": "Missing required field: event",
+		})
+	}
+
+	if requestBody.Locale == "" {
+		requestBody.Locale = DefaultLocale()
+	}
+
+	data := sampleTemplateData()
+	if requestBody.Task != "" {
+		task, err := c.App.FindRecordById("tasks", requestBody.Task)
+		if err != nil {
+			return c.JSON(404, map[string]string{
+				"error": "Task not found",
+			})
+		}
+		data = TaskTemplateData(task)
+	}
+
+	source, locale := requestBody.Body, requestBody.Locale
+	if source == "" {
+		var err error
+		source, locale, err = findTemplate(c.App, requestBody.Event, requestBody.Locale)
+		if err != nil {
+			return c.JSON(404, map[string]string{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	message, err := executeTemplate(source, locale, data)
+	if err != nil {
+		return c.JSON(400, map[string]string{
+			"error":   "Failed to render template",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(200, map[string]any{
+		"event":   requestBody.Event,
+		"locale":  locale,
+		"message": message,
+	})
+}
@@ -0,0 +1,149 @@
+package notification
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errWebhookAddress = errors.New("webhook address is not public")
+
+// WebhookNotifier posts notifications as JSON to an outgoing webhook URL.
+// When NOTIFICATION_WEBHOOK_SECRET is set, the body is signed with HMAC-SHA256
+// in the X-Signature-256 header ("sha256=<hex>").
+//
+// The webhook URLs come from the users and departments, so the requests can only
+// reach public addresses, not the loopback, private or link-local networks of the
+// server. Internal hosts are allowed with NOTIFICATION_WEBHOOK_ALLOWED_HOSTS
+// (comma separated host names).
+type WebhookNotifier struct {
+	secret       string
+	allowedHosts []string
+	client       *http.Client
+	// for the allowed hosts only
+	internalClient *http.Client
+}
+
+func NewWebhookNotifier() *WebhookNotifier {
+	allowedHosts := []string{}
+	for _, host := range strings.Split(os.Getenv("NOTIFICATION_WEBHOOK_ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			allowedHosts = append(allowedHosts, host)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: dialPublicOnly}
+
+	return &WebhookNotifier{
+		secret:       os.Getenv("NOTIFICATION_WEBHOOK_SECRET"),
+		allowedHosts: allowedHosts,
+		// the address is checked when connecting, after the DNS resolution and on redirects
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+		internalClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Whether a webhook may be sent to the IP address
+func isPublicAddress(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// Dialer control rejecting the connections to non-public addresses
+func dialPublicOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !isPublicAddress(ip) {
+		return fmt.Errorf("%w: %s", errWebhookAddress, host)
+	}
+
+	return nil
+}
+
+// Check the webhook URL and pick the client allowed to call it
+func (n *WebhookNotifier) clientFor(address string) (*http.Client, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported webhook URL scheme %q", u.Scheme)
+	}
+
+	if slices.Contains(n.allowedHosts, strings.ToLower(u.Hostname())) {
+		return n.internalClient, nil
+	}
+
+	return n.client, nil
+}
+
+func (n *WebhookNotifier) Name() string {
+	return NotifierWebhook
+}
+
+func (n *WebhookNotifier) Send(msg Message) *PostResult {
+	result := &PostResult{ChannelID: msg.Recipient.Address}
+
+	client, err := n.clientFor(msg.Recipient.Address)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid webhook URL: %v", err)
+		return result
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"recipient": msg.Recipient,
+		"task_id":   msg.TaskID,
+		"subject":   msg.Subject(),
+		"message":   msg.Body,
+	})
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to marshal request data: %v", err)
+		return result
+	}
+
+	req, err := http.NewRequest("POST", msg.Recipient.Address, bytes.NewBuffer(body))
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create HTTP request: %v", err)
+		return result
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to send HTTP request: %v", err)
+		result.Retryable = !errors.Is(err, errWebhookAddress)
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		result.Error = fmt.Sprintf("webhook responded with status %d", resp.StatusCode)
+		result.Retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	}
+
+	return result
+}
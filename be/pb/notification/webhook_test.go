@@ -0,0 +1,75 @@
+package notification
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsPublicAddress(t *testing.T) {
+	cases := map[string]bool{
+		"8.8.8.8":         true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+		"::ffff:10.0.0.1": false,
+		"224.0.0.1":       false,
+	}
+
+	for address, want := range cases {
+		if got := isPublicAddress(net.ParseIP(address)); got != want {
+			t.Errorf("isPublicAddress(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
+
+func TestWebhookNotifierRejectsInternalAddresses(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	n := NewWebhookNotifier()
+	msg := Message{Recipient: Recipient{Notifier: NotifierWebhook, Address: server.URL}, Body: "hello"}
+
+	result := n.Send(msg)
+	if result.Error == "" || result.Retryable {
+		t.Fatalf("expected a non-retryable error, got %+v", result)
+	}
+	if calls != 0 {
+		t.Fatalf("expected no request to the loopback server, got %d", calls)
+	}
+
+	msg.Recipient.Address = "file:///etc/passwd"
+	if result := n.Send(msg); result.Error == "" || result.Retryable {
+		t.Fatalf("expected a non-retryable error for the file scheme, got %+v", result)
+	}
+}
+
+func TestWebhookNotifierAllowedHosts(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	t.Setenv("NOTIFICATION_WEBHOOK_ALLOWED_HOSTS", " example.org, 127.0.0.1 ")
+	n := NewWebhookNotifier()
+
+	result := n.Send(Message{Recipient: Recipient{Notifier: NotifierWebhook, Address: server.URL}, Body: "hello"})
+	if result.Error != "" {
+		t.Fatalf("expected the allowed host to be called, got %+v", result)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 request, got %d", calls)
+	}
+}
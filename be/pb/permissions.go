@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+)
+
+// Permissions granted by the roles (roles.permissions)
+const (
+	permissionTaskCreate       = "task.create"
+	permissionTaskAssignAny    = "task.assign.any"
+	permissionTaskExport       = "task.export"
+	permissionDepartmentManage = "department.manage"
+	permissionMattermostPost   = "mattermost.post"
+	permissionAuditView        = "audit.view"
+)
+
+// Permissions of the user from all of their roles, superusers have every permission
+func userPermissions(app core.App, auth *core.Record) []string {
+	permissions := []string{}
+	if auth == nil || auth.IsSuperuser() || auth.Collection().Name != "users" {
+		return permissions
+	}
+
+	roles, err := app.FindRecordsByIds("roles", auth.GetStringSlice("roles"))
+	if err != nil {
+		return permissions
+	}
+
+	for _, role := range roles {
+		for _, permission := range role.GetStringSlice("permissions") {
+			if !slices.Contains(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+
+	return permissions
+}
+
+// Whether the auth record has the permission, for record hooks and handlers
+func hasPermission(app core.App, auth *core.Record, permission string) bool {
+	if auth == nil {
+		return false
+	}
+	if auth.IsSuperuser() {
+		return true
+	}
+
+	return slices.Contains(userPermissions(app, auth), permission)
+}
+
+// Route middleware rejecting the requests of users without the permission
+func requirePermission(permission string) *hook.Handler[*core.RequestEvent] {
+	return &hook.Handler[*core.RequestEvent]{
+		Id: "requirePermission:" + permission,
+		Func: func(e *core.RequestEvent) error {
+			if e.Auth == nil {
+				return apis.NewUnauthorizedError("The request requires valid authorization token.", nil)
+			}
+			if !hasPermission(e.App, e.Auth, permission) {
+				return apis.NewForbiddenError(fmt.Sprintf("Missing the %q permission.", permission), nil)
+			}
+
+			return e.Next()
+		},
+	}
+}
+
+// Record request hook rejecting the requests of users without the permission
+func requireRecordPermission(permission string) func(e *core.RecordRequestEvent) error {
+	return func(e *core.RecordRequestEvent) error {
+		if !hasPermission(e.App, e.Auth, permission) {
+			return apis.NewForbiddenError(fmt.Sprintf("Missing the %q permission.", permission), nil)
+		}
+
+		return e.Next()
+	}
+}
+
+// Without the task.assign.any permission a user can only assign a task to
+// themselves and to the members of the task departments.
+func canAssignTask(app core.App, auth *core.Record, departmentIds []string, userId string) bool {
+	if userId == auth.Id || hasPermission(app, auth, permissionTaskAssignAny) {
+		return true
+	}
+
+	return slices.Contains(departmentMemberIds(app, departmentIds), userId)
+}
+
+// First assignee added to the task that the auth user isn't allowed to assign, if any
+func unassignableUser(app core.App, auth *core.Record, task *core.Record) string {
+	oldIds := []string{}
+	if !task.IsNew() {
+		oldIds = task.Original().GetStringSlice("assignees")
+	}
+
+	added, _ := diffIds(oldIds, task.GetStringSlice("assignees"))
+	for _, userId := range added {
+		if !canAssignTask(app, auth, task.GetStringSlice("departments"), userId) {
+			return userId
+		}
+	}
+
+	return ""
+}
+
+// Check the assignees added by a task create/update request
+func validateTaskAssignees(e *core.RecordRequestEvent) error {
+	if e.Auth == nil || e.Auth.IsSuperuser() {
+		return e.Next()
+	}
+
+	if userId := unassignableUser(e.App, e.Auth, e.Record); userId != "" {
+		return apis.NewForbiddenError(fmt.Sprintf("Missing the %q permission to assign the task to user %s.", permissionTaskAssignAny, userId), nil)
+	}
+
+	return e.Next()
+}
+
+// Whether a records API request sets or changes the field
+func fieldChanged(record *core.Record, field string) bool {
+	original := record.Original()
+	if record.IsNew() {
+		original = core.NewRecord(record.Collection())
+	}
+
+	oldRaw, _ := json.Marshal(original.Get(field))
+	newRaw, _ := json.Marshal(record.Get(field))
+	return string(oldRaw) != string(newRaw)
+}
+
+// Record request hook letting only superusers set or change the fields, eg. the
+// roles of a user, which grant the permissions
+func superuserOnlyFields(fields ...string) func(e *core.RecordRequestEvent) error {
+	return func(e *core.RecordRequestEvent) error {
+		if e.HasSuperuserAuth() {
+			return e.Next()
+		}
+
+		for _, field := range fields {
+			if fieldChanged(e.Record, field) {
+				return apis.NewForbiddenError(fmt.Sprintf("Only superusers can change %s.", field), nil)
+			}
+		}
+
+		return e.Next()
+	}
+}
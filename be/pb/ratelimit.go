@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+)
+
+// Requests counted in the current window of a key
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// In-memory fixed window rate limiter, eg. 10 requests per minute per user
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[string]*rateWindow
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: map[string]*rateWindow{},
+	}
+}
+
+// Count a request of the key, returns false with the time to wait when over the limit
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	// drop the expired windows once in a while
+	if len(l.windows) > 10000 {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+
+	if w.count >= l.limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+
+	w.count++
+	return true, 0
+}
+
+// Route middleware limiting the requests per key (eg. the auth id or the client IP)
+func rateLimit(limiter *rateLimiter, key func(e *core.RequestEvent) string) *hook.Handler[*core.RequestEvent] {
+	return &hook.Handler[*core.RequestEvent]{
+		Func: func(e *core.RequestEvent) error {
+			if ok, wait := limiter.Allow(key(e)); !ok {
+				e.Response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				return apis.NewTooManyRequestsError(fmt.Sprintf("Too many requests, retry in %s.", wait.Round(time.Second)), nil)
+			}
+
+			return e.Next()
+		},
+	}
+}
+
+// Rate limit key of the auth record, the client IP for guests
+func authRateLimitKey(e *core.RequestEvent) string {
+	if e.Auth != nil {
+		return e.Auth.Collection().Name + ":" + e.Auth.Id
+	}
+	return "ip:" + e.RealIP()
+}
+
+// Rate limit key of the client IP, for the requests before the login
+func ipRateLimitKey(e *core.RequestEvent) string {
+	return "ip:" + e.RealIP()
+}
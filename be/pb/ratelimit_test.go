@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+
+	ok, wait := limiter.Allow("a")
+	if ok {
+		t.Fatal("the request over the limit should be refused")
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Fatalf("wait = %s, want within the window", wait)
+	}
+
+	// keys are counted separately
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Fatal("another key should be allowed")
+	}
+}
+
+func TestRateLimiterWindowReset(t *testing.T) {
+	limiter := newRateLimiter(1, 20*time.Millisecond)
+
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Fatal("the first request should be allowed")
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Fatal("the second request should be refused")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Fatal("the request should be allowed in the next window")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"be.monk.house/notification"
+)
+
+const reminderOverdueKind = "overdue"
+
+// Only the tasks that became overdue within this window are escalated, not the
+// backlog of tasks overdue since long before the reminders were set up
+const overdueEscalationWindow = 24 * time.Hour
+
+// Default reminder settings, overridable with
+// TASK_REMINDER_CRON and TASK_REMINDER_OFFSETS (eg. "24h,1h")
+const (
+	defaultReminderCron    = "*/5 * * * *"
+	defaultReminderOffsets = "24h,1h"
+)
+
+func getReminderCron() string {
+	if expr := os.Getenv("TASK_REMINDER_CRON"); expr != "" {
+		return expr
+	}
+	return defaultReminderCron
+}
+
+// Parse the reminder offsets, smallest first
+func getReminderOffsets() []time.Duration {
+	raw := os.Getenv("TASK_REMINDER_OFFSETS")
+	if raw == "" {
+		raw = defaultReminderOffsets
+	}
+
+	offsets := []time.Duration{}
+	for _, part := range strings.Split(raw, ",") {
+		offset, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || offset <= 0 {
+			log.Printf("Invalid task reminder offset %q: %v", part, err)
+			continue
+		}
+		offsets = append(offsets, offset)
+	}
+
+	slices.Sort(offsets)
+
+	return slices.Compact(offsets)
+}
+
+func reminderKind(offset time.Duration) string {
+	return "before:" + offset.String()
+}
+
+// Send the due-date reminders and overdue escalations that are due.
+// Every sent reminder is recorded in task_reminders so it's sent only once.
+func runTaskReminders(app core.App, outbox *notification.Outbox, offsets []time.Duration) {
+	now := time.Now()
+
+	for i, offset := range offsets {
+		tasks, err := app.FindRecordsByFilter(
+			"tasks",
+			"due_date != '' && due_date > {:now} && due_date <= {:until} && status != 'done' && status != 'canceled'",
+			"due_date",
+			0,
+			0,
+			dbx.Params{
+				"now":   types.NowDateTime().String(),
+				"until": mustDateTime(now.Add(offset)).String(),
+			},
+		)
+		if err != nil {
+			log.Printf("Task reminders: failed to load tasks: %v", err)
+			return
+		}
+
+		for _, task := range tasks {
+			// a task that is already within a smaller offset doesn't need the larger reminders anymore
+			kinds := []string{}
+			for _, larger := range offsets[i:] {
+				kinds = append(kinds, reminderKind(larger))
+			}
+
+			sent, err := claimReminders(app, task, kinds)
+			if err != nil {
+				log.Printf("Task reminders: failed to record reminder for task %s: %v", task.Id, err)
+				continue
+			}
+			if !slices.Contains(sent, reminderKind(offset)) {
+				continue
+			}
+
+			if err := enqueueReminder(app, outbox, notification.EventTaskReminder, task, task.GetStringSlice("assignees"), nil); err != nil {
+				log.Printf("Task reminders: %v", err)
+				releaseReminders(app, task, sent)
+			}
+		}
+	}
+
+	overdue, err := app.FindRecordsByFilter(
+		"tasks",
+		"due_date != '' && due_date > {:since} && due_date <= {:now} && status != 'done' && status != 'canceled'",
+		"due_date",
+		0,
+		0,
+		dbx.Params{
+			"since": mustDateTime(now.Add(-overdueEscalationWindow)).String(),
+			"now":   types.NowDateTime().String(),
+		},
+	)
+	if err != nil {
+		log.Printf("Task reminders: failed to load overdue tasks: %v", err)
+		return
+	}
+
+	for _, task := range overdue {
+		sent, err := claimReminders(app, task, []string{reminderOverdueKind})
+		if err != nil {
+			log.Printf("Task reminders: failed to record escalation for task %s: %v", task.Id, err)
+			continue
+		}
+		if len(sent) == 0 {
+			continue
+		}
+
+		if err := enqueueReminder(app, outbox, notification.EventTaskOverdue, task, task.GetStringSlice("assignees"), task.GetStringSlice("departments")); err != nil {
+			log.Printf("Task reminders: %v", err)
+			releaseReminders(app, task, sent)
+		}
+	}
+}
+
+func enqueueReminder(app core.App, outbox *notification.Outbox, event string, task *core.Record, assigneeIds []string, departmentIds []string) error {
+	recipients, unreachable := resolveTaskRecipients(app, event, assigneeIds, departmentIds)
+	for _, r := range unreachable {
+		log.Printf("Task %s: %s %s has no notification address and was not reminded", task.Id, r.Type, r.ID)
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	return outbox.EnqueueTemplate(recipients, event, notification.TaskTemplateData(task), task.Id)
+}
+
+// Record the reminder kinds for the task and return the ones that weren't recorded before
+func claimReminders(app core.App, task *core.Record, kinds []string) ([]string, error) {
+	collection, err := app.FindCollectionByNameOrId("task_reminders")
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := []string{}
+	for _, kind := range kinds {
+		existing, _ := app.FindFirstRecordByFilter(collection, "task = {:task} && kind = {:kind}", dbx.Params{"task": task.Id, "kind": kind})
+		if existing != nil {
+			continue
+		}
+
+		record := core.NewRecord(collection)
+		record.Set("task", task.Id)
+		record.Set("kind", kind)
+		if err := app.Save(record); err != nil {
+			return claimed, err
+		}
+		claimed = append(claimed, kind)
+	}
+
+	return claimed, nil
+}
+
+// Remove reminder records so the reminders are sent again on the next run
+func releaseReminders(app core.App, task *core.Record, kinds []string) {
+	for _, kind := range kinds {
+		record, err := app.FindFirstRecordByFilter("task_reminders", "task = {:task} && kind = {:kind}", dbx.Params{"task": task.Id, "kind": kind})
+		if err != nil {
+			continue
+		}
+		if err := app.Delete(record); err != nil {
+			log.Printf("Task reminders: failed to release reminder %s of task %s: %v", kind, task.Id, err)
+		}
+	}
+}
+
+// Forget the sent reminders of a task whose due date changed
+func resetTaskReminders(app core.App, task *core.Record) {
+	if task.Original().GetDateTime("due_date").Equal(task.GetDateTime("due_date")) {
+		return
+	}
+
+	records, err := app.FindAllRecords("task_reminders", dbx.HashExp{"task": task.Id})
+	if err != nil {
+		return
+	}
+	for _, record := range records {
+		if err := app.Delete(record); err != nil {
+			log.Printf("Task reminders: failed to reset reminder of task %s: %v", task.Id, err)
+		}
+	}
+}
+
+func mustDateTime(t time.Time) types.DateTime {
+	dt, _ := types.ParseDateTime(t)
+	return dt
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func TestClaimReminders(t *testing.T) {
+	app := newTestApp(t)
+
+	collection, err := app.FindCollectionByNameOrId("tasks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := core.NewRecord(collection)
+	task.Set("title", "Chuẩn bị báo cáo tháng")
+	task.Set("status", "todo")
+	if err := app.Save(task); err != nil {
+		t.Fatal(err)
+	}
+
+	day, hour := reminderKind(24*time.Hour), reminderKind(time.Hour)
+
+	claimed, err := claimReminders(app, task, []string{day, hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(claimed, []string{day, hour}) {
+		t.Fatalf("claimed = %v, want both reminders", claimed)
+	}
+
+	// a reminder is only claimed once
+	claimed, err = claimReminders(app, task, []string{hour, reminderOverdueKind})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(claimed, []string{reminderOverdueKind}) {
+		t.Fatalf("claimed = %v, want only the overdue reminder", claimed)
+	}
+
+	// released reminders can be claimed again
+	releaseReminders(app, task, []string{hour})
+	claimed, err = claimReminders(app, task, []string{day, hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(claimed, []string{hour}) {
+		t.Fatalf("claimed = %v, want the released reminder", claimed)
+	}
+}
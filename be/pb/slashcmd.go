@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+
+	"be.monk.house/notification"
+)
+
+// Max open tasks listed by "/task list"
+const slashListLimit = 20
+
+// Payload of a Mattermost slash command request
+type SlashCommandRequest struct {
+	Token     string `form:"token" json:"token"`
+	TeamID    string `form:"team_id" json:"team_id"`
+	ChannelID string `form:"channel_id" json:"channel_id"`
+	UserID    string `form:"user_id" json:"user_id"`
+	UserName  string `form:"user_name" json:"user_name"`
+	Command   string `form:"command" json:"command"`
+	Text      string `form:"text" json:"text"`
+}
+
+type SlashCommandResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+const slashUsage = "Cách dùng:\n" +
+	"- `/task create <tiêu đề>` tạo công việc mới\n" +
+	"- `/task list` xem các công việc đang mở của bạn\n" +
+	"- `/task done <id>` đánh dấu hoàn thành\n" +
+	"- `/task assign <id> @user` giao công việc cho người khác"
+
+// Check the slash command token against MATTERMOST_SLASH_TOKEN.
+// Mattermost sends it in the payload and as "Authorization: Token <token>".
+func verifySlashToken(c *core.RequestEvent, payloadToken string) bool {
+	expected := os.Getenv("MATTERMOST_SLASH_TOKEN")
+	if expected == "" {
+		return false
+	}
+
+	token := payloadToken
+	if token == "" {
+		token = strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Token ")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// Handle the "/task" slash command. Replies are ephemeral, only the caller sees them.
+func handleSlashCommand(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	var payload SlashCommandRequest
+	if err := c.BindBody(&payload); err != nil {
+		return c.JSON(400, map[string]string{"error": "invalid request"})
+	}
+
+	if !verifySlashToken(c, payload.Token) {
+		return c.JSON(401, map[string]string{"error": "invalid token"})
+	}
+
+	reply := func(text string) error {
+		return c.JSON(200, SlashCommandResponse{ResponseType: "ephemeral", Text: text})
+	}
+
+	// users are linked to their Mattermost account on first login
+	user, err := findUserByMattermostId(app, payload.UserID)
+	if err != nil {
+		return reply(fmt.Sprintf("Bạn chưa có tài khoản, hãy đăng nhập ứng dụng trước: %s", os.Getenv("APP_URL")))
+	}
+
+	subcommand, args, _ := strings.Cut(strings.TrimSpace(payload.Text), " ")
+	args = strings.TrimSpace(args)
+
+	var text string
+	switch strings.ToLower(subcommand) {
+	case "create":
+		text = slashCreateTask(app, user, args)
+	case "list":
+		text = slashListTasks(app, user)
+	case "done":
+		text = slashCompleteTask(app, user, args)
+	case "assign":
+		text = slashAssignTask(app, user, args)
+	default:
+		text = slashUsage
+	}
+
+	return reply(text)
+}
+
+func slashCreateTask(app core.App, user *core.Record, title string) string {
+	if title == "" {
+		return "Thiếu tiêu đề công việc. Ví dụ: `/task create Chuẩn bị báo cáo tháng`"
+	}
+
+	if !hasPermission(app, user, permissionTaskCreate) {
+		return "Bạn không có quyền tạo công việc."
+	}
+
+	collection, err := app.FindCollectionByNameOrId("tasks")
+	if err != nil {
+		return "Không thể tạo công việc, vui lòng thử lại sau."
+	}
+
+	task := core.NewRecord(collection)
+	task.Set("title", title)
+	task.Set("status", "todo")
+	task.Set("assignees", []string{user.Id})
+	task.Set("createdBy", user.Id)
+
+	if err := app.SaveWithContext(withAuditActor(context.Background(), userAuditActor(user)), task); err != nil {
+		return fmt.Sprintf("Không thể tạo công việc: %v", err)
+	}
+
+	return fmt.Sprintf("Đã tạo công việc **%s** (`%s`)\n%s", title, task.Id, taskDetailLink(task.Id))
+}
+
+func slashListTasks(app core.App, user *core.Record) string {
+	tasks := []*core.Record{}
+	err := app.RecordQuery("tasks").
+		AndWhere(jsonArrayContains("assignees", user.Id)).
+		AndWhere(dbx.NotIn("status", "done", "canceled")).
+		OrderBy("due_date ASC").
+		Limit(slashListLimit).
+		All(&tasks)
+	if err != nil {
+		return "Không thể tải danh sách công việc, vui lòng thử lại sau."
+	}
+
+	data := notification.TemplateData{Count: len(tasks)}
+	for _, task := range tasks {
+		data.Tasks = append(data.Tasks, notification.TaskTemplateData(task))
+	}
+
+	text, err := notification.RenderTemplate(app, notification.TemplateTaskList, user.GetString("locale"), data)
+	if err != nil {
+		log.Printf("Failed to render the task list of %s: %v", user.Id, err)
+		return "Không thể tải danh sách công việc, vui lòng thử lại sau."
+	}
+
+	return text
+}
+
+func slashCompleteTask(app core.App, user *core.Record, taskId string) string {
+	if taskId == "" {
+		return "Thiếu mã công việc. Ví dụ: `/task done abc123`"
+	}
+
+	task, err := app.FindRecordById("tasks", taskId)
+	if err != nil {
+		return fmt.Sprintf("Không tìm thấy công việc `%s`.", taskId)
+	}
+
+	if !canChangeTask(app, user, task) {
+		return "Bạn không có quyền cập nhật công việc này."
+	}
+
+	if task.GetString("status") == "done" {
+		return fmt.Sprintf("Công việc **%s** đã hoàn thành trước đó.", task.GetString("title"))
+	}
+
+	task.Set("status", "done")
+	task.Set("updatedBy", user.Id)
+
+	if err := app.SaveWithContext(withAuditActor(context.Background(), userAuditActor(user)), task); err != nil {
+		return fmt.Sprintf("Không thể cập nhật công việc: %v", err)
+	}
+
+	return fmt.Sprintf("Đã hoàn thành công việc **%s**", task.GetString("title"))
+}
+
+func slashAssignTask(app core.App, user *core.Record, args string) string {
+	fields := strings.Fields(args)
+	if len(fields) != 2 || !strings.HasPrefix(fields[1], "@") {
+		return "Cú pháp: `/task assign <id> @user`"
+	}
+
+	task, err := app.FindRecordById("tasks", fields[0])
+	if err != nil {
+		return fmt.Sprintf("Không tìm thấy công việc `%s`.", fields[0])
+	}
+
+	if !canChangeTask(app, user, task) {
+		return "Bạn không có quyền cập nhật công việc này."
+	}
+
+	username := strings.TrimPrefix(fields[1], "@")
+	assignee, err := app.FindFirstRecordByFilter("users", "username = {:username}", dbx.Params{"username": username})
+	if err != nil {
+		return fmt.Sprintf("Không tìm thấy người dùng @%s, họ cần đăng nhập ứng dụng ít nhất một lần.", username)
+	}
+
+	assignees := task.GetStringSlice("assignees")
+	if slices.Contains(assignees, assignee.Id) {
+		return fmt.Sprintf("@%s đã được giao công việc **%s**.", username, task.GetString("title"))
+	}
+
+	if !canAssignTask(app, user, task.GetStringSlice("departments"), assignee.Id) {
+		return fmt.Sprintf("Bạn không có quyền giao công việc cho @%s.", username)
+	}
+
+	task.Set("assignees", append(assignees, assignee.Id))
+	task.Set("updatedBy", user.Id)
+
+	if err := app.SaveWithContext(withAuditActor(context.Background(), userAuditActor(user)), task); err != nil {
+		return fmt.Sprintf("Không thể cập nhật công việc: %v", err)
+	}
+
+	return fmt.Sprintf("Đã giao công việc **%s** cho @%s", task.GetString("title"), username)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+
+	"be.monk.house/notification"
+)
+
+// Marks task saves that send their own notifications instead of the per-task ones
+type skipTaskNotificationsKey struct{}
+
+func withoutTaskNotifications(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipTaskNotificationsKey{}, true)
+}
+
+func taskNotificationsSkipped(ctx context.Context) bool {
+	return ctx != nil && ctx.Value(skipTaskNotificationsKey{}) != nil
+}
+
+// Resolve the notification addresses of the task assignees and departments for the event,
+// honoring the assignees' notification preferences.
+// Assignees and departments without any address are returned as unreachable.
+func resolveTaskRecipients(app core.App, event string, assigneeIds []string, departmentIds []string) ([]notification.Recipient, []notification.Recipient) {
+	recipients := []notification.Recipient{}
+	unreachable := []notification.Recipient{}
+
+	for _, userId := range assigneeIds {
+		var resolved []notification.Recipient
+		user, err := app.FindRecordById("users", userId)
+		if err == nil && user != nil {
+			var wanted bool
+			resolved, wanted = notification.ResolveUser(app, user, event)
+			if !wanted {
+				continue
+			}
+		}
+		if len(resolved) == 0 {
+			unreachable = append(unreachable, notification.Recipient{Type: notification.RecipientUser, ID: userId})
+			continue
+		}
+		recipients = append(recipients, resolved...)
+	}
+
+	for _, deptId := range departmentIds {
+		var resolved []notification.Recipient
+		dept, err := app.FindRecordById("departments", deptId)
+		if err == nil && dept != nil {
+			resolved = notification.DepartmentRecipients(dept)
+		}
+		if len(resolved) == 0 {
+			unreachable = append(unreachable, notification.Recipient{Type: notification.RecipientDepartment, ID: deptId})
+			continue
+		}
+		recipients = append(recipients, resolved...)
+	}
+
+	return recipients, unreachable
+}
+
+func taskDetailLink(taskId string) string {
+	return notification.TaskLink(taskId)
+}
+
+// Queue the new-task announcement for the task assignees and departments
+func notifyTaskCreated(app core.App, outbox *notification.Outbox, task *core.Record) {
+	recipients, unreachable := resolveTaskRecipients(app, notification.EventTaskCreated, task.GetStringSlice("assignees"), task.GetStringSlice("departments"))
+	for _, r := range unreachable {
+		log.Printf("Task %s: %s %s has no notification address and was not notified", task.Id, r.Type, r.ID)
+	}
+
+	if err := outbox.EnqueueTemplate(recipients, notification.EventTaskCreated, notification.TaskTemplateData(task), task.Id); err != nil {
+		log.Println(err)
+	}
+}
+
+// Split the ids into the ones added to and removed from the old list
+func diffIds(oldIds []string, newIds []string) ([]string, []string) {
+	added := []string{}
+	removed := []string{}
+
+	for _, id := range newIds {
+		if !slices.Contains(oldIds, id) {
+			added = append(added, id)
+		}
+	}
+	for _, id := range oldIds {
+		if !slices.Contains(newIds, id) {
+			removed = append(removed, id)
+		}
+	}
+
+	return added, removed
+}
+
+// The user who changed the task, from the request or the context of the save.
+// Superuser, job and system saves don't restamp updatedBy, it only names the
+// actor when the save changed it.
+func taskChangeActor(e *core.RecordEvent) string {
+	if actor := auditActorOf(e); actor.Type == "user" {
+		return actor.Id
+	}
+
+	if updatedBy := e.Record.GetString("updatedBy"); updatedBy != e.Record.Original().GetString("updatedBy") {
+		return updatedBy
+	}
+
+	return ""
+}
+
+// Queue targeted messages for the changes of an updated task:
+// added/removed assignees and departments, status transitions and due date changes.
+// The actor isn't notified about their own change.
+func notifyTaskUpdated(app core.App, outbox *notification.Outbox, task *core.Record, actorId string) {
+	original := task.Original()
+	data := notification.TaskTemplateData(task)
+
+	send := func(event string, assigneeIds []string, departmentIds []string) {
+		recipients, unreachable := resolveTaskRecipients(app, event, assigneeIds, departmentIds)
+		for _, r := range unreachable {
+			log.Printf("Task %s: %s %s has no notification address and was not notified", task.Id, r.Type, r.ID)
+		}
+		if len(recipients) == 0 {
+			return
+		}
+		if err := outbox.EnqueueTemplate(recipients, event, data, task.Id); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// don't notify the user about their own change
+	withoutActor := func(ids []string) []string {
+		return slices.DeleteFunc(slices.Clone(ids), func(id string) bool { return id == actorId })
+	}
+
+	addedAssignees, removedAssignees := diffIds(original.GetStringSlice("assignees"), task.GetStringSlice("assignees"))
+	if added := withoutActor(addedAssignees); len(added) > 0 {
+		send(notification.EventTaskAssigned, added, nil)
+	}
+	if removed := withoutActor(removedAssignees); len(removed) > 0 {
+		send(notification.EventTaskUnassigned, removed, nil)
+	}
+
+	addedDepartments, _ := diffIds(original.GetStringSlice("departments"), task.GetStringSlice("departments"))
+	if len(addedDepartments) > 0 {
+		send(notification.EventTaskCreated, nil, addedDepartments)
+	}
+
+	if original.GetString("status") != task.GetString("status") {
+		creatorId := task.GetString("createdBy")
+		if creatorId != "" && creatorId != actorId {
+			send(notification.EventTaskStatus, []string{creatorId}, nil)
+		}
+	}
+
+	if !original.GetDateTime("due_date").Equal(task.GetDateTime("due_date")) {
+		// newly added assignees already got the task with its new due date
+		current := slices.DeleteFunc(withoutActor(task.GetStringSlice("assignees")), func(id string) bool {
+			return slices.Contains(addedAssignees, id)
+		})
+		if len(current) > 0 {
+			send(notification.EventTaskDueChanged, current, nil)
+		}
+	}
+}
+
+// Only the creator, the assignees and the department managers of a task can change it from chat
+func canChangeTask(app core.App, user *core.Record, task *core.Record) bool {
+	return task.GetString("createdBy") == user.Id ||
+		slices.Contains(task.GetStringSlice("assignees"), user.Id) ||
+		isDepartmentManager(app, user.Id, task.GetStringSlice("departments"))
+}
+
+// Check the collection view rule of the record for the request auth
+func canViewRecord(c *core.RequestEvent, record *core.Record) bool {
+	if c.HasSuperuserAuth() {
+		return true
+	}
+
+	requestInfo, err := c.RequestInfo()
+	if err != nil {
+		return false
+	}
+
+	canAccess, err := c.App.CanAccessRecord(record, requestInfo, record.Collection().ViewRule)
+	return err == nil && canAccess
+}
+
+// Report which assignees and departments of a task were notified
+func handleTaskNotificationReport(c *core.RequestEvent, app *pocketbase.PocketBase) error {
+	task, err := app.FindRecordById("tasks", c.Request.PathValue("id"))
+	if err != nil {
+		return c.JSON(404, map[string]string{"error": "task not found"})
+	}
+
+	if !canViewRecord(c, task) {
+		return c.JSON(403, map[string]string{"error": "not allowed to view this task"})
+	}
+
+	// including the consolidated messages of the tasks created in bulk
+	entries, err := app.FindAllRecords(notification.OutboxCollection, dbx.Or(
+		dbx.HashExp{"task": task.Id},
+		jsonArrayContains("tasks", task.Id),
+	))
+	if err != nil {
+		return c.JSON(500, map[string]string{"error": "failed to load notifications"})
+	}
+
+	byRecipient := map[string][]*core.Record{}
+	for _, entry := range entries {
+		key := entry.GetString("recipient_type") + ":" + entry.GetString("recipient_id")
+		byRecipient[key] = append(byRecipient[key], entry)
+	}
+
+	report := func(typ string, ids []string) []map[string]any {
+		items := []map[string]any{}
+		for _, id := range ids {
+			deliveries := []map[string]any{}
+			statuses := []string{}
+			for _, entry := range byRecipient[typ+":"+id] {
+				statuses = append(statuses, entry.GetString("status"))
+				deliveries = append(deliveries, map[string]any{
+					"notifier": entry.GetString("notifier"),
+					"address":  entry.GetString("address"),
+					"status":   entry.GetString("status"),
+					"attempts": entry.GetInt("attempts"),
+					"error":    entry.GetString("last_error"),
+					"created":  entry.GetDateTime("created"),
+				})
+			}
+
+			// notified as soon as one of the notifiers delivered
+			status := "unreachable"
+			for _, s := range []string{notification.OutboxStatusSent, notification.OutboxStatusPending, notification.OutboxStatusDead} {
+				if slices.Contains(statuses, s) {
+					status = s
+					break
+				}
+			}
+
+			items = append(items, map[string]any{"id": id, "status": status, "deliveries": deliveries})
+		}
+		return items
+	}
+
+	return c.JSON(200, map[string]any{
+		"assignees":   report(notification.RecipientUser, task.GetStringSlice("assignees")),
+		"departments": report(notification.RecipientDepartment, task.GetStringSlice("departments")),
+	})
+}
+
+// Expression matching the records whose multiple value column (eg. the assignees
+// relation, stored as a JSON array) contains the value
+func jsonArrayContains(column string, value string) dbx.Expression {
+	return dbx.NewExp(
+		fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(CASE WHEN json_valid([[%[1]s]]) THEN [[%[1]s]] ELSE json_array([[%[1]s]]) END) WHERE json_each.value = {:%[1]s})", column),
+		dbx.Params{column: value},
+	)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+
+	"be.monk.house/notification"
+)
+
+// Notified users of the event for the task
+func outboxRecipients(t *testing.T, app core.App, task *core.Record, event string) []string {
+	t.Helper()
+
+	records, err := app.FindAllRecords(notification.OutboxCollection, dbx.HashExp{"task": task.Id, "event": event})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, record := range records {
+		ids = append(ids, record.GetString("recipient_id"))
+	}
+	return ids
+}
+
+func TestNotifyTaskUpdatedBySuperuser(t *testing.T) {
+	app := newTestApp(t)
+	outbox := notification.NewOutbox(app)
+
+	creator := newTestUser(t, app, "creator@example.org")
+	editor := newTestUser(t, app, "editor@example.org")
+
+	collection, err := app.FindCollectionByNameOrId("tasks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := core.NewRecord(collection)
+	task.Set("title", "Chuẩn bị báo cáo tháng")
+	task.Set("status", "todo")
+	task.Set("createdBy", creator.Id)
+	// the last user who edited the task
+	task.Set("updatedBy", editor.Id)
+	if err := app.Save(task); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err = app.FindRecordById("tasks", task.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a superuser assigns the last editor, updatedBy is left as it was
+	task.Set("assignees", []string{editor.Id})
+	task.Set("status", "in_progress")
+
+	e := &core.RecordEvent{}
+	e.Record = task
+	e.Context = withAuditActor(context.Background(), &auditActor{Id: "superuser", Type: "superuser"})
+
+	actorId := taskChangeActor(e)
+	if actorId != "" {
+		t.Fatalf("actor = %q, want none for a superuser edit", actorId)
+	}
+
+	notifyTaskUpdated(app, outbox, task, actorId)
+
+	if got := outboxRecipients(t, app, task, notification.EventTaskAssigned); len(got) == 0 || got[0] != editor.Id {
+		t.Fatalf("assigned notifications = %v, want the last editor", got)
+	}
+	if got := outboxRecipients(t, app, task, notification.EventTaskStatus); len(got) == 0 || got[0] != creator.Id {
+		t.Fatalf("status notifications = %v, want the creator", got)
+	}
+}
+
+func TestTaskChangeActor(t *testing.T) {
+	app := newTestApp(t)
+	user := newTestUser(t, app, "an@example.org")
+	other := newTestUser(t, app, "binh@example.org")
+
+	collection, err := app.FindCollectionByNameOrId("tasks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := core.NewRecord(collection)
+	task.Set("title", "Kiểm kê kho")
+	task.Set("updatedBy", other.Id)
+	if err := app.Save(task); err != nil {
+		t.Fatal(err)
+	}
+	task, err = app.FindRecordById("tasks", task.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a user acting from chat
+	e := &core.RecordEvent{}
+	e.Record = task
+	e.Context = withAuditActor(context.Background(), userAuditActor(user))
+	if got := taskChangeActor(e); got != user.Id {
+		t.Errorf("actor = %q, want the user of the save context", got)
+	}
+
+	// a job save that doesn't touch updatedBy
+	e.Context = context.Background()
+	if got := taskChangeActor(e); got != "" {
+		t.Errorf("actor = %q, want none when updatedBy wasn't changed", got)
+	}
+
+	// a save that names its user
+	task.Set("updatedBy", user.Id)
+	if got := taskChangeActor(e); got != user.Id {
+		t.Errorf("actor = %q, want the new updatedBy", got)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const mattermostTokensCollection = "mattermost_tokens"
+
+// Access tokens expiring within this margin are refreshed
+const mattermostTokenRefreshMargin = 10 * time.Minute
+
+var errNoMattermostToken = errors.New("no Mattermost token for the user")
+
+// Mattermost OAuth tokens of the users, encrypted with MATTERMOST_TOKEN_KEY (32 characters).
+// Without a key the tokens are not stored and the features fall back to the bot.
+type mattermostTokenStore struct {
+	app core.App
+	key string
+
+	// one refresh at a time, a refresh token can only be used once
+	mu sync.Mutex
+}
+
+func newMattermostTokenStore(app core.App) *mattermostTokenStore {
+	key := os.Getenv("MATTERMOST_TOKEN_KEY")
+	if key != "" && len(key) != 32 {
+		log.Printf("MATTERMOST_TOKEN_KEY must be 32 characters, the Mattermost tokens are not stored")
+		key = ""
+	}
+
+	return &mattermostTokenStore{app: app, key: key}
+}
+
+// Save encrypts and stores the tokens of the user, after the login or a refresh
+func (s *mattermostTokenStore) Save(userId string, token *OAuthTokenResponse) error {
+	if s.key == "" || token.AccessToken == "" {
+		return nil
+	}
+
+	record, err := s.app.FindFirstRecordByFilter(mattermostTokensCollection, "user = {:user}", dbx.Params{"user": userId})
+	if err != nil {
+		collection, err := s.app.FindCollectionByNameOrId(mattermostTokensCollection)
+		if err != nil {
+			return err
+		}
+		record = core.NewRecord(collection)
+		record.Set("user", userId)
+	}
+
+	return s.save(record, token)
+}
+
+func (s *mattermostTokenStore) save(record *core.Record, token *OAuthTokenResponse) error {
+	accessToken, err := security.Encrypt([]byte(token.AccessToken), s.key)
+	if err != nil {
+		return err
+	}
+	record.Set("access_token", accessToken)
+
+	// Mattermost may not send a new refresh token, the current one stays valid
+	if token.RefreshToken != "" {
+		refreshToken, err := security.Encrypt([]byte(token.RefreshToken), s.key)
+		if err != nil {
+			return err
+		}
+		record.Set("refresh_token", refreshToken)
+	}
+
+	expiresAt := types.DateTime{}
+	if token.ExpiresIn > 0 {
+		expiresAt, _ = types.ParseDateTime(time.Now().Add(time.Duration(token.ExpiresIn) * time.Second))
+	}
+	record.Set("expires_at", expiresAt)
+
+	return s.app.Save(record)
+}
+
+func (s *mattermostTokenStore) decrypt(record *core.Record, field string) (string, error) {
+	value, err := security.Decrypt(record.GetString(field), s.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt the Mattermost %s of user %s: %w", field, record.GetString("user"), err)
+	}
+	return string(value), nil
+}
+
+func expiresSoon(record *core.Record) bool {
+	expiresAt := record.GetDateTime("expires_at")
+	return !expiresAt.IsZero() && time.Until(expiresAt.Time()) < mattermostTokenRefreshMargin
+}
+
+// Refresh the access token of the record if it expires soon. A rejected refresh
+// token is deleted, the user has to log in again.
+func (s *mattermostTokenStore) refresh(record *core.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// refreshed by another request in the meantime
+	record, err := s.app.FindRecordById(mattermostTokensCollection, record.Id)
+	if err != nil {
+		return errNoMattermostToken
+	}
+	if !expiresSoon(record) {
+		return nil
+	}
+
+	refreshToken, err := s.decrypt(record, "refresh_token")
+	if err != nil {
+		return err
+	}
+	if refreshToken == "" {
+		return errNoMattermostToken
+	}
+
+	config := getMattermostConfig()
+	token, err := requestOAuthToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {config.ClientID},
+		"client_secret": {config.ClientSecret},
+		"refresh_token": {refreshToken},
+		"redirect_uri":  {config.RedirectURI},
+	})
+
+	var apiErr *mattermostAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 {
+		log.Printf("Mattermost token of user %s was rejected: %v", record.GetString("user"), err)
+		if err := s.app.Delete(record); err != nil {
+			log.Printf("Failed to delete the Mattermost token of user %s: %v", record.GetString("user"), err)
+		}
+		return errNoMattermostToken
+	}
+	if err != nil {
+		return fmt.Errorf("failed to refresh the Mattermost token of user %s: %w", record.GetString("user"), err)
+	}
+
+	return s.save(record, token)
+}
+
+// RefreshExpiring refreshes the access tokens expiring soon, run by a cron
+func (s *mattermostTokenStore) RefreshExpiring() {
+	if s.key == "" {
+		return
+	}
+
+	records, err := s.app.FindAllRecords(
+		mattermostTokensCollection,
+		dbx.NewExp("expires_at != '' AND expires_at < {:before}", dbx.Params{
+			"before": types.NowDateTime().Add(mattermostTokenRefreshMargin).String(),
+		}),
+	)
+	if err != nil {
+		log.Printf("Mattermost token refresh: %v", err)
+		return
+	}
+
+	for _, record := range records {
+		if err := s.refresh(record); err != nil && !errors.Is(err, errNoMattermostToken) {
+			log.Printf("Mattermost token refresh: %v", err)
+		}
+	}
+}
+
+// Mattermost API client acting as a user
+type mattermostClient struct {
+	UserId      string
+	accessToken string
+}
+
+// Request calls the Mattermost API as the user, the JSON response is decoded into out
+func (c *mattermostClient) Request(method string, path string, body any, out any) error {
+	return mattermostRequest(c.accessToken, method, path, body, out)
+}
+
+// ClientForUser returns a Mattermost client acting as the user, with the token
+// refreshed first when it expires soon. Returns errNoMattermostToken when the
+// user has no usable token, the callers fall back to the bot.
+func (s *mattermostTokenStore) ClientForUser(userId string) (*mattermostClient, error) {
+	if s.key == "" {
+		return nil, errNoMattermostToken
+	}
+
+	record, err := s.app.FindFirstRecordByFilter(mattermostTokensCollection, "user = {:user}", dbx.Params{"user": userId})
+	if err != nil {
+		return nil, errNoMattermostToken
+	}
+
+	if expiresSoon(record) {
+		if err := s.refresh(record); err != nil {
+			return nil, err
+		}
+		if record, err = s.app.FindRecordById(mattermostTokensCollection, record.Id); err != nil {
+			return nil, errNoMattermostToken
+		}
+	}
+
+	accessToken, err := s.decrypt(record, "access_token")
+	if err != nil {
+		return nil, err
+	}
+
+	return &mattermostClient{UserId: userId, accessToken: accessToken}, nil
+}
+
+// AccessToken returns the Mattermost access token of the user, the outbox posts
+// the feedback replies of the user with it
+func (s *mattermostTokenStore) AccessToken(userId string) (string, error) {
+	client, err := s.ClientForUser(userId)
+	if err != nil {
+		return "", err
+	}
+
+	return client.accessToken, nil
+}
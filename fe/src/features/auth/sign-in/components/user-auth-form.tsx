@@ -2,6 +2,7 @@ import { z } from 'zod'
 import { useForm } from 'react-hook-form'
 import { zodResolver } from '@hookform/resolvers/zod'
 import { IconMattermost } from '@/assets/brand-icons'
+import { createLoginChallenge } from '@/lib/oauth'
 import { Button } from '@/components/ui/button'
 import { Form } from '@/components/ui/form'
 
@@ -68,9 +69,10 @@ export function UserAuthForm() {
   //   }
   // }
 
-  const handleMattermostLogin = () => {
-    // Redirect to Mattermost OAuth endpoint
-    const mattermostOAuthUrl = `${import.meta.env.VITE_POCKETBASE_URL}/api/auth/mattermost/login`
+  const handleMattermostLogin = async () => {
+    // Redirect to Mattermost OAuth endpoint, bound to this tab
+    const challenge = await createLoginChallenge()
+    const mattermostOAuthUrl = `${import.meta.env.VITE_POCKETBASE_URL}/api/auth/mattermost/login?challenge=${challenge}`
     window.location.href = mattermostOAuthUrl
   }
 
@@ -0,0 +1,37 @@
+/**
+ * Browser binding of the Mattermost login: the SHA-256 of a random verifier
+ * is sent when the login starts, the exchange code is only given back for
+ * the verifier kept in this tab.
+ */
+
+const VERIFIER_KEY = 'oauth_verifier'
+
+function base64Url(bytes: Uint8Array): string {
+  return btoa(String.fromCharCode(...bytes))
+    .replace(/\+/g, '-')
+    .replace(/\//g, '_')
+    .replace(/=+$/, '')
+}
+
+/**
+ * Create and keep a new verifier, returns its challenge
+ */
+export async function createLoginChallenge(): Promise<string> {
+  const verifier = base64Url(crypto.getRandomValues(new Uint8Array(32)))
+  sessionStorage.setItem(VERIFIER_KEY, verifier)
+
+  const digest = await crypto.subtle.digest(
+    'SHA-256',
+    new TextEncoder().encode(verifier)
+  )
+  return base64Url(new Uint8Array(digest))
+}
+
+/**
+ * Get the verifier of the login and forget it, it can only be used once
+ */
+export function takeLoginVerifier(): string {
+  const verifier = sessionStorage.getItem(VERIFIER_KEY) ?? ''
+  sessionStorage.removeItem(VERIFIER_KEY)
+  return verifier
+}
@@ -3,6 +3,7 @@ import { z } from 'zod'
 import { createFileRoute, useNavigate } from '@tanstack/react-router'
 import { Loader2 } from 'lucide-react'
 import { toast } from 'sonner'
+import { takeLoginVerifier } from '@/lib/oauth'
 import { pb } from '@/lib/pocketbase'
 
 const searchSchema = z.object({
@@ -35,7 +36,7 @@ function OAuthCallback() {
             headers: {
               'Content-Type': 'application/json',
             },
-            body: JSON.stringify({ code }),
+            body: JSON.stringify({ code, verifier: takeLoginVerifier() }),
           }
         )
 